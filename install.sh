@@ -140,6 +140,18 @@ do_copy()
         chmod 600 ${TARGET}/k3os/system/config.yaml
     fi
 
+    if [ -n "$K3OS_INSTALL_SECRET_KEY" ] || [ -n "$K3OS_INSTALL_SEALED_SECRET_KEY" ]; then
+        mkdir -p ${TARGET}/k3os/data/var/lib/rancher/k3os
+        if [ -n "$K3OS_INSTALL_SECRET_KEY" ]; then
+            cp "$K3OS_INSTALL_SECRET_KEY" ${TARGET}/k3os/data/var/lib/rancher/k3os/secret.key
+            chmod 600 ${TARGET}/k3os/data/var/lib/rancher/k3os/secret.key
+        fi
+        if [ -n "$K3OS_INSTALL_SEALED_SECRET_KEY" ]; then
+            cp "$K3OS_INSTALL_SEALED_SECRET_KEY" ${TARGET}/k3os/data/var/lib/rancher/k3os/secret.key.ctx
+            chmod 600 ${TARGET}/k3os/data/var/lib/rancher/k3os/secret.key.ctx
+        fi
+    fi
+
     if [ "$K3OS_INSTALL_TAKE_OVER" = "true" ]; then
         touch ${TARGET}/k3os/system/takeover
 
@@ -1,22 +1,98 @@
 package cc
 
 import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
 	"github.com/rancher/k3os/pkg/config"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
-type applier func(cfg *config.CloudConfig) error
+type applier struct {
+	name  string
+	apply func(cfg *config.CloudConfig) error
+	// plan returns the changes apply would make, appliers without a plan are always run
+	plan func(cfg *config.CloudConfig) ([]Change, error)
+}
+
+// FatalError is returned when a step with the fatal policy fails, the steps after it are skipped.
+type FatalError struct {
+	Name string
+	Err  error
+}
 
-func runApplies(cfg *config.CloudConfig, appliers ...applier) error {
-	var errors []error
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Name, e.Err)
+}
 
+func runApplies(phase string, cfg *config.CloudConfig, appliers ...applier) error {
+	var (
+		errors []error
+		fatal  *FatalError
+	)
+
+	report := &Report{
+		Phase:   phase,
+		Started: time.Now(),
+	}
 	for _, a := range appliers {
-		err := a(cfg)
+		if fatal != nil {
+			report.Results = append(report.Results, Result{Name: a.name, Status: StatusSkipped})
+			continue
+		}
+
+		start := time.Now()
+		if a.plan != nil {
+			changes, err := a.plan(cfg)
+			if err != nil {
+				logrus.Debugf("failed to plan %s: %v", a.name, err)
+			} else if len(changes) == 0 {
+				report.Results = append(report.Results, Result{
+					Name:       a.name,
+					Status:     StatusUnchanged,
+					DurationMS: time.Since(start).Milliseconds(),
+				})
+				continue
+			}
+		}
+
+		err := a.apply(cfg)
+		result := Result{
+			Name:       a.name,
+			Status:     StatusOK,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
 		if err != nil {
-			errors = append(errors, err)
+			result.Error = err.Error()
+			switch cfg.K3OS.Policy(a.name) {
+			case config.PolicyWarn:
+				result.Status = StatusWarning
+				logrus.Warnf("%s failed: %v", a.name, err)
+			case config.PolicyFatal:
+				result.Status = StatusFailed
+				fatal = &FatalError{Name: a.name, Err: err}
+			default:
+				result.Status = StatusFailed
+				errors = append(errors, err)
+			}
 		}
+		report.Results = append(report.Results, result)
 	}
+	report.Finished = time.Now()
 
+	if err := writeReport(report); err != nil {
+		logrus.Warnf("failed to write %s report: %v", phase, err)
+	}
+
+	if fatal != nil {
+		for _, err := range errors {
+			logrus.Error(err)
+		}
+		return fatal
+	}
 	if len(errors) > 0 {
 		return cli.NewMultiError(errors...)
 	}
@@ -24,53 +100,126 @@ func runApplies(cfg *config.CloudConfig, appliers ...applier) error {
 	return nil
 }
 
+// dryRun writes the changes each applier would make to w, without making them.
+func dryRun(w io.Writer, cfg *config.CloudConfig, appliers ...applier) {
+	for _, a := range appliers {
+		if a.plan == nil {
+			fmt.Fprintf(w, "# %s: always applied\n", a.name)
+			continue
+		}
+		changes, err := a.plan(cfg)
+		if err != nil {
+			fmt.Fprintf(w, "# %s: unknown: %v\n", a.name, err)
+			continue
+		}
+		if len(changes) == 0 {
+			fmt.Fprintf(w, "# %s: unchanged\n", a.name)
+			continue
+		}
+		fmt.Fprintf(w, "# %s\n", a.name)
+		for _, c := range changes {
+			fmt.Fprint(w, c.Diff())
+		}
+	}
+}
+
+// DryRun writes the changes that applying cfg in phase would make to w.
+func DryRun(w io.Writer, phase string, cfg *config.CloudConfig) error {
+	appliers, ok := phases[phase]
+	if !ok {
+		return fmt.Errorf("unknown phase %q", phase)
+	}
+	dryRun(w, cfg, appliers...)
+	return nil
+}
+
+var phases = map[string][]applier{
+	"runtime": {
+		{name: "http", apply: ApplyHTTP},
+		{name: "modules", apply: ApplyModules, plan: planModules},
+		{name: "sysctls", apply: ApplySysctls, plan: planSysctls},
+		{name: "hostname", apply: ApplyHostname, plan: planHostname},
+		{name: "dns", apply: ApplyDNS, plan: planDNS},
+		{name: "wifi", apply: ApplyWifi, plan: planWifi},
+		{name: "password", apply: ApplyPassword, plan: planPassword},
+		{name: "ssh_authorized_keys", apply: ApplySSHKeysWithNet},
+		{name: "sshd", apply: ApplySSHD},
+		{name: "write_files", apply: ApplyWriteFilesWithNet, plan: planWriteFiles(false)},
+		{name: "remote_files", apply: ApplyRemoteFilesWithNet, plan: planRemoteFiles},
+		{name: "environment", apply: ApplyEnvironment, plan: planEnvironment},
+		{name: "run_cmd", apply: ApplyRuncmd},
+		{name: "install", apply: ApplyInstall},
+		{name: "k3s", apply: ApplyK3SInstall, plan: planK3S(true, true)},
+		{name: "write_files_deferred", apply: ApplyDeferredWriteFilesWithNet, plan: planWriteFiles(true)},
+	},
+	"install": {
+		{name: "k3s", apply: ApplyK3SWithRestart, plan: planK3S(true, false)},
+	},
+	"boot": {
+		{name: "http", apply: ApplyHTTP},
+		{name: "data_sources", apply: ApplyDataSource, plan: planDataSource},
+		{name: "watch", apply: ApplyWatch, plan: planWatch},
+		{name: "modules", apply: ApplyModules, plan: planModules},
+		{name: "sysctls", apply: ApplySysctls, plan: planSysctls},
+		{name: "hostname", apply: ApplyHostname, plan: planHostname},
+		{name: "network", apply: ApplyNetwork},
+		{name: "dns", apply: ApplyDNS, plan: planDNS},
+		{name: "wifi", apply: ApplyWifi, plan: planWifi},
+		{name: "users", apply: ApplyUsers},
+		{name: "password", apply: ApplyPassword, plan: planPassword},
+		{name: "ssh_authorized_keys", apply: ApplySSHKeys},
+		{name: "sshd", apply: ApplySSHD},
+		{name: "remote_files", apply: ApplyRemoteFiles, plan: planRemoteFiles},
+		{name: "k3s", apply: ApplyK3SNoRestart, plan: planK3S(false, false)},
+		{name: "write_files", apply: ApplyWriteFiles, plan: planWriteFiles(false)},
+		{name: "environment", apply: ApplyEnvironment, plan: planEnvironment},
+		{name: "boot_cmd", apply: ApplyBootcmd},
+		{name: "write_files_deferred", apply: ApplyDeferredWriteFiles, plan: planWriteFiles(true)},
+	},
+	"initrd": {
+		{name: "modules", apply: ApplyModules, plan: planModules},
+		{name: "sysctls", apply: ApplySysctls, plan: planSysctls},
+		{name: "hostname", apply: ApplyHostname, plan: planHostname},
+		{name: "users", apply: ApplyUsers},
+		{name: "write_files", apply: applyInitrdWriteFiles(false), plan: planWriteFiles(false)},
+		{name: "environment", apply: ApplyEnvironment, plan: planEnvironment},
+		{name: "init_cmd", apply: ApplyInitcmd},
+		{name: "write_files_deferred", apply: applyInitrdWriteFiles(true), plan: planWriteFiles(true)},
+	},
+}
+
+func init() {
+	config.Steps = stepNames()
+}
+
+// stepNames returns the names of the steps of all phases, sorted.
+func stepNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, appliers := range phases {
+		for _, a := range appliers {
+			if !seen[a.name] {
+				seen[a.name] = true
+				names = append(names, a.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func RunApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
-		ApplyModules,
-		ApplySysctls,
-		ApplyHostname,
-		ApplyDNS,
-		ApplyWifi,
-		ApplyPassword,
-		ApplySSHKeysWithNet,
-		ApplyWriteFiles,
-		ApplyEnvironment,
-		ApplyRuncmd,
-		ApplyInstall,
-		ApplyK3SInstall,
-	)
+	return runApplies("runtime", cfg, phases["runtime"]...)
 }
 
 func InstallApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
-		ApplyK3SWithRestart,
-	)
+	return runApplies("install", cfg, phases["install"]...)
 }
 
 func BootApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
-		ApplyDataSource,
-		ApplyModules,
-		ApplySysctls,
-		ApplyHostname,
-		ApplyDNS,
-		ApplyWifi,
-		ApplyPassword,
-		ApplySSHKeys,
-		ApplyK3SNoRestart,
-		ApplyWriteFiles,
-		ApplyEnvironment,
-		ApplyBootcmd,
-	)
+	return runApplies("boot", cfg, phases["boot"]...)
 }
 
 func InitApply(cfg *config.CloudConfig) error {
-	return runApplies(cfg,
-		ApplyModules,
-		ApplySysctls,
-		ApplyHostname,
-		ApplyWriteFiles,
-		ApplyEnvironment,
-		ApplyInitcmd,
-	)
+	return runApplies("initrd", cfg, phases["initrd"]...)
 }
@@ -0,0 +1,141 @@
+package cc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+type edit struct {
+	op   byte
+	line string
+	// a and b are the number of lines of each side before this edit
+	a, b int
+}
+
+// unifiedDiff returns the differences between current and desired in unified format, or "" if there are none.
+func unifiedDiff(name, current, desired string) string {
+	if current == desired {
+		return ""
+	}
+
+	edits := diffLines(splitLines(current), splitLines(desired))
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", name, name)
+
+	for i := 0; i < len(edits); {
+		first := nextChange(edits, i)
+		if first < 0 {
+			break
+		}
+		last := first
+		for {
+			next := nextChange(edits, last+1)
+			if next < 0 || next-last > 2*diffContext {
+				break
+			}
+			last = next
+		}
+
+		start := maxInt(i, first-diffContext)
+		end := minInt(len(edits), last+1+diffContext)
+		aLen, bLen := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(edits[start].a, aLen), hunkRange(edits[start].b, bLen))
+		for _, e := range edits[start:end] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+
+	return buf.String()
+}
+
+// diffLines returns the edits turning a into b, based on their longest common subsequence.
+func diffLines(a, b []string) []edit {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = maxInt(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{op: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{op: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			edits = append(edits, edit{op: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return edits
+}
+
+func nextChange(edits []edit, from int) int {
+	for i := from; i < len(edits); i++ {
+		if edits[i].op != ' ' {
+			return i
+		}
+	}
+	return -1
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
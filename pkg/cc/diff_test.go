@@ -0,0 +1,57 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func numbered(from, to int) string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name, current, desired, expected string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", ""},
+		{
+			"new file", "", "a\nb\n",
+			"@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"removed file", "a\n", "",
+			"@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			"two hunks",
+			numbered(1, 16),
+			strings.Replace(numbered(1, 16), "3\n", "three\n", 1) + "seventeen\n",
+			"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+				"@@ -14,3 +14,4 @@\n 14\n 15\n 16\n+seventeen\n",
+		},
+		{
+			"changes close together share a hunk",
+			numbered(1, 10),
+			strings.Replace(strings.Replace(numbered(1, 10), "2\n", "two\n", 1), "8\n", "eight\n", 1),
+			"@@ -1,10 +1,10 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+		{
+			"no newline at end of file", "x\ny", "x\nz\n",
+			"@@ -1,2 +1,2 @@\n x\n-y\n\\ No newline at end of file\n+z\n",
+		},
+	}
+	for _, tt := range tests {
+		expected := tt.expected
+		if expected != "" {
+			expected = "--- /etc/file\n+++ /etc/file\n" + expected
+		}
+		if got := unifiedDiff("/etc/file", tt.current, tt.desired); got != expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", tt.name, got, expected)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,13 +18,32 @@ import (
 	"github.com/rancher/k3os/pkg/hostname"
 	"github.com/rancher/k3os/pkg/mode"
 	"github.com/rancher/k3os/pkg/module"
+	"github.com/rancher/k3os/pkg/netconf"
+	"github.com/rancher/k3os/pkg/remotefile"
 	"github.com/rancher/k3os/pkg/ssh"
 	"github.com/rancher/k3os/pkg/sysctl"
+	"github.com/rancher/k3os/pkg/system"
+	"github.com/rancher/k3os/pkg/users"
+	"github.com/rancher/k3os/pkg/util"
 	"github.com/rancher/k3os/pkg/version"
 	"github.com/rancher/k3os/pkg/writefile"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
+const (
+	connmanConfig   = "/etc/connman/main.conf"
+	connmanSettings = "/var/lib/connman/settings"
+	connmanServices = "/var/lib/connman/cloud-config.config"
+	cloudConfigConf = "/etc/conf.d/cloud-config"
+	ccwatchConf     = "/etc/conf.d/ccwatch"
+	environmentFile = "/etc/environment"
+	systemCABundle  = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// k3sCABundle is the system CA bundle along with the certificates of k3os.http, for k3s-install.sh.
+var k3sCABundle = system.StatePath("ca-certificates.crt")
+
 func ApplyModules(cfg *config.CloudConfig) error {
 	return module.LoadModules(cfg)
 }
@@ -35,8 +56,16 @@ func ApplyHostname(cfg *config.CloudConfig) error {
 	return hostname.SetHostname(cfg)
 }
 
+func ApplyNetwork(cfg *config.CloudConfig) error {
+	return netconf.ConfigureNetwork(cfg)
+}
+
 func ApplyPassword(cfg *config.CloudConfig) error {
-	return command.SetPassword(cfg.K3OS.Password)
+	return command.SetPassword("rancher", cfg.K3OS.Password)
+}
+
+func ApplyUsers(cfg *config.CloudConfig) error {
+	return users.ConfigureUsers(cfg)
 }
 
 func ApplyRuncmd(cfg *config.CloudConfig) error {
@@ -52,8 +81,26 @@ func ApplyInitcmd(cfg *config.CloudConfig) error {
 }
 
 func ApplyWriteFiles(cfg *config.CloudConfig) error {
-	writefile.WriteFiles(cfg)
-	return nil
+	return writefile.WriteFiles(cfg, writefile.Options{})
+}
+
+func ApplyWriteFilesWithNet(cfg *config.CloudConfig) error {
+	return writefile.WriteFiles(cfg, writefile.Options{WithNet: true})
+}
+
+func ApplyDeferredWriteFiles(cfg *config.CloudConfig) error {
+	return writefile.WriteFiles(cfg, writefile.Options{Deferred: true})
+}
+
+func ApplyDeferredWriteFilesWithNet(cfg *config.CloudConfig) error {
+	return writefile.WriteFiles(cfg, writefile.Options{Deferred: true, WithNet: true})
+}
+
+// the initrd phase leaves files owned by users that do not exist yet to the boot phase
+func applyInitrdWriteFiles(deferred bool) func(cfg *config.CloudConfig) error {
+	return func(cfg *config.CloudConfig) error {
+		return writefile.WriteFiles(cfg, writefile.Options{Deferred: deferred, RetryLater: true})
+	}
 }
 
 func ApplySSHKeys(cfg *config.CloudConfig) error {
@@ -64,6 +111,26 @@ func ApplySSHKeysWithNet(cfg *config.CloudConfig) error {
 	return ssh.SetAuthorizedKeys(cfg, true)
 }
 
+func ApplyHTTP(cfg *config.CloudConfig) error {
+	opts, err := cfg.K3OS.HTTP.Options()
+	if err != nil {
+		return fmt.Errorf("invalid k3os.http: %v", err)
+	}
+	return util.ConfigureHTTP(opts)
+}
+
+func ApplyRemoteFiles(cfg *config.CloudConfig) error {
+	return remotefile.FetchRemoteFiles(cfg, false)
+}
+
+func ApplyRemoteFilesWithNet(cfg *config.CloudConfig) error {
+	return remotefile.FetchRemoteFiles(cfg, true)
+}
+
+func ApplySSHD(cfg *config.CloudConfig) error {
+	return ssh.ConfigureSSHD(cfg)
+}
+
 func ApplyK3SWithRestart(cfg *config.CloudConfig) error {
 	return ApplyK3S(cfg, true, false)
 }
@@ -77,12 +144,39 @@ func ApplyK3SNoRestart(cfg *config.CloudConfig) error {
 }
 
 func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
-	mode, err := mode.Get()
+	args, vars, ok, err := k3sInstall(cfg, restart, install)
+	if err != nil || !ok {
+		return err
+	}
+	if err := writeCABundle(cfg.K3OS.HTTP); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/usr/libexec/k3os/k3s-install.sh", args...)
+	cmd.Env = append(os.Environ(), vars...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	cmd.Stdin = os.Stdin
+	logrus.Debugf("Running %s %v %v", cmd.Path, cmd.Args, vars)
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	certs, err := caCertificates(cfg.K3OS.HTTP)
 	if err != nil {
 		return err
 	}
+	return writeState("k3s", k3sState(args, vars, certs))
+}
+
+// k3sInstall returns the arguments and environment to run k3s-install.sh with, or false if it should not be run.
+func k3sInstall(cfg *config.CloudConfig, restart, install bool) ([]string, []string, bool, error) {
+	mode, err := mode.Get()
+	if err != nil {
+		return nil, nil, false, err
+	}
 	if mode == "install" {
-		return nil
+		return nil, nil, false, nil
 	}
 
 	k3sExists := false
@@ -98,9 +192,10 @@ func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
 	vars := []string{
 		"INSTALL_K3S_NAME=service",
 	}
+	vars = append(vars, httpVars(cfg.K3OS.HTTP)...)
 
 	if !k3sExists && !restart {
-		return nil
+		return nil, nil, false, nil
 	}
 
 	if k3sExists {
@@ -110,7 +205,7 @@ func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
 	} else if k3sLocalExists {
 		vars = append(vars, "INSTALL_K3S_SKIP_DOWNLOAD=true")
 	} else if !install {
-		return nil
+		return nil, nil, false, nil
 	}
 
 	if !restart {
@@ -152,14 +247,60 @@ func ApplyK3S(cfg *config.CloudConfig, restart, install bool) error {
 		args = append(args, "--kubelet-arg", "register-with-taints="+taint)
 	}
 
-	cmd := exec.Command("/usr/libexec/k3os/k3s-install.sh", args...)
-	cmd.Env = append(os.Environ(), vars...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	logrus.Debugf("Running %s %v %v", cmd.Path, cmd.Args, vars)
+	return args, vars, true, nil
+}
 
-	return cmd.Run()
+// httpVars returns the proxies and CA bundle of k3os.http for k3s-install.sh, which also passes the
+// proxies on to the k3s service.
+func httpVars(h *config.HTTP) []string {
+	if h == nil {
+		return nil
+	}
+	var vars []string
+	if h.HTTPProxy != "" {
+		vars = append(vars, "HTTP_PROXY="+h.HTTPProxy)
+	}
+	if h.HTTPSProxy != "" {
+		vars = append(vars, "HTTPS_PROXY="+h.HTTPSProxy)
+	}
+	if noProxy := h.NoProxyList(); noProxy != "" {
+		vars = append(vars, "NO_PROXY="+noProxy)
+	}
+	if h.CABundle != "" || h.CACerts != "" {
+		vars = append(vars, "CURL_CA_BUNDLE="+k3sCABundle, "SSL_CERT_FILE="+k3sCABundle)
+	}
+	return vars
+}
+
+// caCertificates returns the CA certificates of k3os.http, or nothing if it has none.
+func caCertificates(h *config.HTTP) ([]byte, error) {
+	if h == nil || (h.CABundle == "" && h.CACerts == "") {
+		return nil, nil
+	}
+	return h.CACertificates()
+}
+
+// writeCABundle writes k3sCABundle, if k3os.http has CA certificates. curl only trusts the bundle it is
+// given, so the system CA certificates are included.
+func writeCABundle(h *config.HTTP) error {
+	if h == nil || (h.CABundle == "" && h.CACerts == "") {
+		return nil
+	}
+	certs, err := h.CACertificates()
+	if err != nil {
+		return err
+	}
+	bundle, err := ioutil.ReadFile(systemCABundle)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+		bundle = append(bundle, '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(k3sCABundle), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(k3sCABundle, append(bundle, certs...), 0644)
 }
 
 func ApplyInstall(cfg *config.CloudConfig) error {
@@ -179,9 +320,19 @@ func ApplyInstall(cfg *config.CloudConfig) error {
 }
 
 func ApplyDNS(cfg *config.CloudConfig) error {
+	if err := ioutil.WriteFile(connmanConfig, dnsConfig(cfg), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", connmanConfig, err)
+	}
+
+	return nil
+}
+
+func dnsConfig(cfg *config.CloudConfig) []byte {
 	buf := &bytes.Buffer{}
 	buf.WriteString("[General]\n")
-	buf.WriteString("NetworkInterfaceBlacklist=veth\n")
+	buf.WriteString("NetworkInterfaceBlacklist=")
+	buf.WriteString(strings.Join(append([]string{"veth"}, netconf.Unmanaged(cfg)...), ","))
+	buf.WriteString("\n")
 	buf.WriteString("PreferredTechnologies=ethernet,wifi\n")
 	if len(cfg.K3OS.DNSNameservers) > 0 {
 		dns := strings.Join(cfg.K3OS.DNSNameservers, ",")
@@ -199,12 +350,7 @@ func ApplyDNS(cfg *config.CloudConfig) error {
 		buf.WriteString("\n")
 	}
 
-	err := ioutil.WriteFile("/etc/connman/main.conf", buf.Bytes(), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write /etc/connman/main.conf: %v", err)
-	}
-
-	return nil
+	return buf.Bytes()
 }
 
 func ApplyWifi(cfg *config.CloudConfig) error {
@@ -212,46 +358,98 @@ func ApplyWifi(cfg *config.CloudConfig) error {
 		return nil
 	}
 
+	if err := os.MkdirAll("/var/lib/connman", 0755); err != nil {
+		return fmt.Errorf("failed to mkdir /var/lib/connman: %v", err)
+	}
+	if err := ioutil.WriteFile(connmanSettings, wifiSettings(), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", connmanSettings, err)
+	}
+
+	services, err := wifiServices(cfg)
+	if err := ioutil.WriteFile(connmanServices, services, 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", connmanServices, err)
+	}
+	return err
+}
+
+func wifiSettings() []byte {
 	buf := &bytes.Buffer{}
 
 	buf.WriteString("[WiFi]\n")
 	buf.WriteString("Enable=true\n")
 	buf.WriteString("Tethering=false\n")
 
-	if buf.Len() > 0 {
-		if err := os.MkdirAll("/var/lib/connman", 0755); err != nil {
-			return fmt.Errorf("failed to mkdir /var/lib/connman: %v", err)
-		}
-		if err := ioutil.WriteFile("/var/lib/connman/settings", buf.Bytes(), 0644); err != nil {
-			return fmt.Errorf("failed to write to /var/lib/connman/settings: %v", err)
-		}
-	}
+	return buf.Bytes()
+}
 
-	buf = &bytes.Buffer{}
+// wifiServices renders the valid networks, along with an error for each invalid network.
+func wifiServices(cfg *config.CloudConfig) ([]byte, error) {
+	buf := &bytes.Buffer{}
 
 	buf.WriteString("[global]\n")
 	buf.WriteString("Name=cloud-config\n")
 	buf.WriteString("Description=Services defined in the cloud-config\n")
 
+	var errs []error
 	for i, w := range cfg.K3OS.Wifi {
-		name := fmt.Sprintf("wifi%d", i)
-		buf.WriteString("[service_")
-		buf.WriteString(name)
-		buf.WriteString("]\n")
+		if err := w.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid wifi network %q: %v", w.Name, err))
+			continue
+		}
+		for _, warning := range w.Warnings() {
+			logrus.Warnf("wifi network %q: %s", w.Name, warning)
+		}
+		fmt.Fprintf(buf, "[service_wifi%d]\n", i)
 		buf.WriteString("Type=wifi\n")
-		buf.WriteString("Passphrase=")
-		buf.WriteString(w.Passphrase)
-		buf.WriteString("\n")
-		buf.WriteString("Name=")
-		buf.WriteString(w.Name)
-		buf.WriteString("\n")
+		writeServiceKey(buf, "Passphrase", w.Passphrase)
+		writeServiceKey(buf, "Name", w.Name)
+		writeServiceKey(buf, "Security", w.WifiSecurity())
+		if w.Hidden {
+			writeServiceKey(buf, "Hidden", "true")
+		}
+		writeServiceKey(buf, "EAP", w.EAP)
+		writeServiceKey(buf, "Identity", w.Identity)
+		writeServiceKey(buf, "AnonymousIdentity", w.AnonymousIdentity)
+		writeServiceKey(buf, "Phase2", w.Phase2)
+		writeServiceKey(buf, "CACertFile", w.CACertFile)
+		writeServiceKey(buf, "ClientCertFile", w.ClientCertFile)
+		writeServiceKey(buf, "PrivateKeyFile", w.PrivateKeyFile)
+		writeServiceKey(buf, "PrivateKeyPassphrase", w.PrivateKeyPassphrase)
+		writeServiceKey(buf, "DomainSuffixMatch", w.DomainSuffixMatch)
+		for _, addr := range w.Addresses {
+			ip, network, _ := net.ParseCIDR(addr)
+			if ip.To4() != nil {
+				writeServiceKey(buf, "IPv4", serviceAddress(ip.String(), net.IP(network.Mask).String(), w.Gateway))
+			} else {
+				ones, _ := network.Mask.Size()
+				writeServiceKey(buf, "IPv6", serviceAddress(ip.String(), strconv.Itoa(ones), w.Gateway6))
+			}
+		}
+		writeServiceKey(buf, "Nameservers", strings.Join(w.Nameservers, ","))
 	}
 
-	if buf.Len() > 0 {
-		return ioutil.WriteFile("/var/lib/connman/cloud-config.config", buf.Bytes(), 0644)
+	if len(errs) > 0 {
+		return buf.Bytes(), cli.NewMultiError(errs...)
 	}
+	return buf.Bytes(), nil
+}
 
-	return nil
+func writeServiceKey(buf *bytes.Buffer, key, value string) {
+	if value == "" {
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteString("=")
+	buf.WriteString(value)
+	buf.WriteString("\n")
+}
+
+// serviceAddress formats a static address as connman expects it: address/netmask[/gateway]
+func serviceAddress(ip, mask, gateway string) string {
+	if gateway == "" {
+		return ip + "/" + mask
+	}
+	return ip + "/" + mask + "/" + gateway
 }
 
 func ApplyDataSource(cfg *config.CloudConfig) error {
@@ -259,6 +457,14 @@ func ApplyDataSource(cfg *config.CloudConfig) error {
 		return nil
 	}
 
+	if err := ioutil.WriteFile(cloudConfigConf, dataSourceConfig(cfg), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", cloudConfigConf, err)
+	}
+
+	return nil
+}
+
+func dataSourceConfig(cfg *config.CloudConfig) []byte {
 	args := strings.Join(cfg.K3OS.DataSources, " ")
 	buf := &bytes.Buffer{}
 
@@ -266,19 +472,40 @@ func ApplyDataSource(cfg *config.CloudConfig) error {
 	buf.WriteString(args)
 	buf.WriteString("\"\n")
 
-	if err := ioutil.WriteFile("/etc/conf.d/cloud-config", buf.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write to /etc/conf.d/cloud-config: %v", err)
-	}
+	return buf.Bytes()
+}
 
+// ApplyWatch writes the conf.d file of ccwatch if k3os.watch is set, which the boot adds to the default
+// runlevel.
+func ApplyWatch(cfg *config.CloudConfig) error {
+	if !cfg.K3OS.Watch {
+		return nil
+	}
+	if err := ioutil.WriteFile(ccwatchConf, watchConfig(), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", ccwatchConf, err)
+	}
 	return nil
 }
 
+func watchConfig() []byte {
+	return []byte("# k3os.watch is set\n")
+}
+
 func ApplyEnvironment(cfg *config.CloudConfig) error {
 	if len(cfg.K3OS.Environment) == 0 {
 		return nil
 	}
+	if err := ioutil.WriteFile(environmentFile, environmentConfig(cfg), 0644); err != nil {
+		return fmt.Errorf("failed to write to %s: %v", environmentFile, err)
+	}
+
+	return nil
+}
+
+// environmentConfig merges the environment in cfg into /etc/environment.
+func environmentConfig(cfg *config.CloudConfig) []byte {
 	env := make(map[string]string, len(cfg.K3OS.Environment))
-	if buf, err := ioutil.ReadFile("/etc/environment"); err == nil {
+	if buf, err := ioutil.ReadFile(environmentFile); err == nil {
 		scanner := bufio.NewScanner(bytes.NewReader(buf))
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -304,16 +531,17 @@ func ApplyEnvironment(cfg *config.CloudConfig) error {
 	for key, val := range cfg.K3OS.Environment {
 		env[key] = val
 	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	buf := &bytes.Buffer{}
-	for key, val := range env {
+	for _, key := range keys {
 		buf.WriteString(key)
 		buf.WriteString("=")
-		buf.WriteString(strconv.Quote(val))
+		buf.WriteString(strconv.Quote(env[key]))
 		buf.WriteString("\n")
 	}
-	if err := ioutil.WriteFile("/etc/environment", buf.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write to /etc/environment: %v", err)
-	}
-
-	return nil
+	return buf.Bytes()
 }
@@ -0,0 +1,363 @@
+package cc
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/module"
+	"github.com/rancher/k3os/pkg/remotefile"
+	"github.com/rancher/k3os/pkg/sysctl"
+	"github.com/rancher/k3os/pkg/system"
+	"github.com/rancher/k3os/pkg/users"
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/rancher/k3os/pkg/writefile"
+)
+
+// Change is the difference between the current state of part of the system and the state an applier
+// would leave it in.
+type Change struct {
+	Name    string
+	Current string
+	Desired string
+}
+
+// Diff returns the change in unified format.
+func (c Change) Diff() string {
+	return unifiedDiff(c.Name, c.Current, c.Desired)
+}
+
+// changes returns the non-empty changes.
+func changes(all ...Change) []Change {
+	var result []Change
+	for _, c := range all {
+		if c.Current != c.Desired {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func fileChange(path string, desired []byte) Change {
+	current, _ := ioutil.ReadFile(path)
+	return Change{
+		Name:    path,
+		Current: string(current),
+		Desired: string(desired),
+	}
+}
+
+func statePath(name string) string {
+	return system.StatePath("state", name)
+}
+
+func writeState(name, content string) error {
+	if err := os.MkdirAll(filepath.Dir(statePath(name)), 0700); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(statePath(name), []byte(content), 0600)
+}
+
+func lines(items []string) string {
+	if len(items) == 0 {
+		return ""
+	}
+	return strings.Join(items, "\n") + "\n"
+}
+
+func planModules(cfg *config.CloudConfig) ([]Change, error) {
+	pending, err := module.Pending(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pendingSet := map[string]bool{}
+	for _, m := range pending {
+		pendingSet[m.Name] = true
+	}
+	var loaded, desired []string
+	for _, m := range cfg.K3OS.Modules {
+		if !m.ShouldLoad() {
+			continue
+		}
+		desired = append(desired, m.Name)
+		if !pendingSet[m.Name] {
+			loaded = append(loaded, m.Name)
+		}
+	}
+	content, err := module.Config(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return changes(
+		fileChange(module.ModprobeConfig, content),
+		Change{
+			Name:    "loaded modules",
+			Current: lines(loaded),
+			Desired: lines(desired),
+		},
+	), nil
+}
+
+func planSysctls(cfg *config.CloudConfig) ([]Change, error) {
+	var result []Change
+	for k, v := range cfg.K3OS.Sysctls {
+		current, _ := sysctl.Current(k)
+		result = append(result, Change{
+			Name:    sysctl.Path(k),
+			Current: lines([]string{strings.Join(strings.Fields(current), " ")}),
+			Desired: lines([]string{strings.Join(strings.Fields(v), " ")}),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return changes(result...), nil
+}
+
+func planHostname(cfg *config.CloudConfig) ([]Change, error) {
+	if cfg.Hostname == "" {
+		return nil, nil
+	}
+	current, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return changes(Change{
+		Name:    "hostname",
+		Current: lines([]string{current}),
+		Desired: lines([]string{cfg.Hostname}),
+	}), nil
+}
+
+func planDNS(cfg *config.CloudConfig) ([]Change, error) {
+	return changes(fileChange(connmanConfig, dnsConfig(cfg))), nil
+}
+
+func planWifi(cfg *config.CloudConfig) ([]Change, error) {
+	if len(cfg.K3OS.Wifi) == 0 {
+		return nil, nil
+	}
+	services, err := wifiServices(cfg)
+	if err != nil {
+		// run the applier so that the invalid networks are reported
+		return nil, err
+	}
+	return changes(
+		fileChange(connmanSettings, wifiSettings()),
+		fileChange(connmanServices, services),
+	), nil
+}
+
+func planDataSource(cfg *config.CloudConfig) ([]Change, error) {
+	if len(cfg.K3OS.DataSources) == 0 {
+		return nil, nil
+	}
+	return changes(fileChange(cloudConfigConf, dataSourceConfig(cfg))), nil
+}
+
+func planWatch(cfg *config.CloudConfig) ([]Change, error) {
+	if !cfg.K3OS.Watch {
+		return nil, nil
+	}
+	return changes(fileChange(ccwatchConf, watchConfig())), nil
+}
+
+func planEnvironment(cfg *config.CloudConfig) ([]Change, error) {
+	if len(cfg.K3OS.Environment) == 0 {
+		return nil, nil
+	}
+	return changes(fileChange(environmentFile, environmentConfig(cfg))), nil
+}
+
+func planPassword(cfg *config.CloudConfig) ([]Change, error) {
+	password := cfg.K3OS.Password
+	if password == "" {
+		return nil, nil
+	}
+
+	// a clear text password is set again every time, only a hashed one can be compared
+	if strings.HasPrefix(password, "$") && shadowPassword("rancher") == password {
+		return nil, nil
+	}
+	return []Change{{
+		Name:    "password of rancher",
+		Desired: "<redacted>\n",
+	}}, nil
+}
+
+func planWriteFiles(deferred bool) func(cfg *config.CloudConfig) ([]Change, error) {
+	return func(cfg *config.CloudConfig) ([]Change, error) {
+		var result []Change
+		for _, f := range cfg.WriteFiles {
+			if f.Defer != deferred {
+				continue
+			}
+			if f.LinkTarget != "" {
+				current, _ := os.Readlink(f.Path)
+				result = append(result, Change{
+					Name:    f.Path + " (link)",
+					Current: lines([]string{current}),
+					Desired: lines([]string{f.LinkTarget}),
+				})
+				continue
+			}
+
+			content, ok, err := writefile.Content(&f, false)
+			switch {
+			case err != nil:
+				// let the applier report it
+				result = append(result, Change{Name: f.Path, Desired: f.Content})
+				continue
+			case !ok:
+				current, _ := ioutil.ReadFile(f.Path)
+				result = append(result, Change{
+					Name:    f.Path,
+					Current: string(current),
+					Desired: fmt.Sprintf("# fetched from %s\n", f.Source.URL),
+				})
+			case f.Append:
+				current, _ := ioutil.ReadFile(f.Path)
+				result = append(result, fileChange(f.Path, writefile.Appended(current, content)))
+			default:
+				result = append(result, fileChange(f.Path, content))
+			}
+
+			perm, err := f.Permissions()
+			if err != nil {
+				continue
+			}
+			info, err := os.Stat(f.Path)
+			if err != nil {
+				continue
+			}
+			result = append(result, Change{
+				Name:    f.Path + " (mode)",
+				Current: fmt.Sprintf("%04o\n", info.Mode().Perm()),
+				Desired: fmt.Sprintf("%04o\n", perm),
+			})
+			if f.Owner != "" && !ownedBy(info, f.Owner) {
+				result = append(result, Change{
+					Name:    f.Path + " (owner)",
+					Current: fmt.Sprintf("%d:%d\n", fileUID(info), fileGID(info)),
+					Desired: f.Owner + "\n",
+				})
+			}
+		}
+		return changes(result...), nil
+	}
+}
+
+func planRemoteFiles(cfg *config.CloudConfig) ([]Change, error) {
+	var result []Change
+	for _, r := range cfg.K3OS.RemoteFiles {
+		if r.SHA256 == "" || !remotefile.Current(r) {
+			current, _ := ioutil.ReadFile(r.Path)
+			result = append(result, Change{
+				Name:    r.Path,
+				Current: string(current),
+				Desired: fmt.Sprintf("# downloaded from %s\n", r.URL),
+			})
+			continue
+		}
+		perm, err := r.Permissions()
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(r.Path); err == nil {
+			result = append(result, Change{
+				Name:    r.Path + " (mode)",
+				Current: fmt.Sprintf("%04o\n", info.Mode().Perm()),
+				Desired: fmt.Sprintf("%04o\n", perm),
+			})
+		}
+	}
+	return changes(result...), nil
+}
+
+func planK3S(restart, install bool) func(cfg *config.CloudConfig) ([]Change, error) {
+	return func(cfg *config.CloudConfig) ([]Change, error) {
+		args, vars, ok, err := k3sInstall(cfg, restart, install)
+		if err != nil || !ok {
+			return nil, err
+		}
+		certs, err := caCertificates(cfg.K3OS.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		current, _ := ioutil.ReadFile(statePath("k3s"))
+		return changes(Change{
+			Name:    "k3s service",
+			Current: string(current),
+			Desired: k3sState(args, vars, certs),
+		}), nil
+	}
+}
+
+// k3sState describes the installed k3s service, without any secrets. The CA certificates of k3os.http
+// are included by their hash, so that changing them writes the CA bundle and installs k3s again.
+func k3sState(args, vars []string, certs []byte) string {
+	var env []string
+	if len(certs) > 0 {
+		env = append(env, fmt.Sprintf("CA_CERTIFICATES=sha256:%x", sha256.Sum256(certs)))
+	}
+	for _, v := range vars {
+		kv := strings.SplitN(v, "=", 2)
+		switch kv[0] {
+		case "INSTALL_K3S_SKIP_START":
+			continue
+		case "K3S_TOKEN", "K3S_CLUSTER_SECRET":
+			v = fmt.Sprintf("%s=sha256:%x", kv[0], sha256.Sum256([]byte(kv[1])))
+		case "HTTP_PROXY", "HTTPS_PROXY":
+			// the proxy may include a password
+			if strings.Contains(kv[1], "@") {
+				v = fmt.Sprintf("%s=sha256:%x", kv[0], sha256.Sum256([]byte(kv[1])))
+			}
+		}
+		env = append(env, v)
+	}
+	sort.Strings(env)
+	return lines(append(append([]string{}, args...), env...))
+}
+
+func shadowPassword(username string) string {
+	bytes, err := ioutil.ReadFile("/etc/shadow")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 1 && fields[0] == username {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// ownedBy reports whether info is owned by owner, given as user, user:group or numeric ids.
+func ownedBy(info os.FileInfo, owner string) bool {
+	uid, gid, err := users.ResolveOwner(owner)
+	if err != nil {
+		return false
+	}
+	return (uid == -1 || uid == fileUID(info)) && (gid == -1 || gid == fileGID(info))
+}
+
+func fileUID(info os.FileInfo) int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid)
+	}
+	return -1
+}
+
+func fileGID(info os.FileInfo) int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Gid)
+	}
+	return -1
+}
@@ -0,0 +1,93 @@
+package cc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/k3os/pkg/system"
+)
+
+const (
+	StatusOK        = "ok"
+	StatusFailed    = "failed"
+	StatusWarning   = "warning"
+	StatusSkipped   = "skipped"
+	StatusUnchanged = "unchanged"
+)
+
+// Report records the result of each applier run in a phase of `k3os config`.
+type Report struct {
+	Phase    string    `json:"phase"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Results  []Result  `json:"results"`
+}
+
+// Result is the outcome of a single applier.
+type Result struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Failed returns the number of appliers that failed.
+func (r *Report) Failed() int {
+	count := 0
+	for _, result := range r.Results {
+		if result.Status == StatusFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// reportDir is a variable for the tests.
+var reportDir = system.StatePath("report")
+
+// ReportDir holds one report per phase, named after the phase.
+func ReportDir() string {
+	return reportDir
+}
+
+func writeReport(r *Report) error {
+	if err := os.MkdirAll(ReportDir(), 0755); err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ReportDir(), r.Phase+".json")
+	if err := ioutil.WriteFile(path+".tmp", append(bytes, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LastReport returns the most recently started report of any phase, or nil if no phase has run.
+func LastReport() (*Report, error) {
+	files, err := filepath.Glob(filepath.Join(ReportDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var last *Report
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		r := &Report{}
+		if err := json.Unmarshal(bytes, r); err != nil {
+			return nil, err
+		}
+		if last == nil || r.Started.After(last.Started) {
+			last = r
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,69 @@
+package cc
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { reportDir = dir }(reportDir)
+	reportDir = dir
+
+	if last, err := LastReport(); err != nil || last != nil {
+		t.Fatalf("got %v, %v, expected no report before any phase ran", last, err)
+	}
+
+	started := time.Date(2019, 10, 17, 10, 0, 0, 0, time.UTC)
+	boot := &Report{
+		Phase:    "boot",
+		Started:  started,
+		Finished: started.Add(time.Second),
+		Results: []Result{
+			{Name: "modules", Status: StatusOK, DurationMS: 12},
+			{Name: "wifi", Status: StatusFailed, DurationMS: 3, Error: "invalid wifi network"},
+			{Name: "k3s", Status: StatusSkipped},
+			{Name: "sysctls", Status: StatusFailed, DurationMS: 1, Error: "sysctl vm.swappiness"},
+		},
+	}
+	runtime := &Report{
+		Phase:   "runtime",
+		Started: started.Add(time.Minute),
+		Results: []Result{{Name: "modules", Status: StatusUnchanged}},
+	}
+	// written out of order, the latest start wins rather than the latest write
+	for _, r := range []*Report{runtime, boot} {
+		if err := writeReport(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last, err := LastReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(last, runtime) {
+		t.Errorf("got %+v, expected the runtime report", last)
+	}
+
+	boot.Started = started.Add(time.Hour)
+	if err := writeReport(boot); err != nil {
+		t.Fatal(err)
+	}
+	if last, err = LastReport(); err != nil || !reflect.DeepEqual(last, boot) {
+		t.Errorf("got %+v, %v, expected the rewritten boot report", last, err)
+	}
+	if failed := last.Failed(); failed != 2 {
+		t.Errorf("got %d failed, expected 2", failed)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("got %d files, expected one report per phase", len(files))
+	}
+}
@@ -0,0 +1,247 @@
+package cc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchEvents   = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	watchDebounce = 2 * time.Second
+	watchRetry    = time.Minute
+)
+
+// Watch applies the runtime-safe parts of the config whenever the config files change, until it fails.
+func Watch() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	dirs := map[int32]string{}
+	addWatches(fd, dirs)
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	events := make(chan inotifyEvent)
+	errs := make(chan error, 1)
+	go readEvents(fd, events, errs)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case e := <-events:
+			path := filepath.Join(dirs[e.wd], e.name)
+			if !config.IsConfigPath(path) {
+				continue
+			}
+			logrus.Debugf("%s changed", path)
+			reload = time.After(watchDebounce)
+		case err := <-errs:
+			return err
+		case <-reload:
+			reload = nil
+			// config.d may have been created since the last reload
+			addWatches(fd, dirs)
+			newCfg, err := config.ReadConfig()
+			if err != nil {
+				logrus.Errorf("failed to read config, keeping the current config: %v", err)
+				continue
+			}
+			// the config is only taken as applied once it is, so that the failed steps are applied again
+			if err := WatchApply(&cfg, &newCfg); err != nil {
+				logrus.Errorf("failed to apply the config, retrying in %v: %v", watchRetry, err)
+				reload = time.After(watchRetry)
+				continue
+			}
+			cfg = newCfg
+		}
+	}
+}
+
+// WatchApply logs the differences between two configs and applies the runtime-safe parts of the new one.
+func WatchApply(old, cfg *config.CloudConfig) error {
+	diffs, err := config.Diff(config.Redact(*old), config.Redact(*cfg))
+	if err != nil {
+		return err
+	}
+	if len(diffs) == 0 {
+		logrus.Info("config reloaded, nothing changed")
+		return nil
+	}
+	for _, d := range diffs {
+		logrus.WithFields(logrus.Fields{
+			"key": d.Key,
+			"old": jsonString(d.Old),
+			"new": jsonString(d.New),
+		}).Info("config changed")
+	}
+
+	return runApplies("watch", cfg,
+		applier{name: "http", apply: ApplyHTTP},
+		applier{name: "modules", apply: ApplyModules, plan: planModules},
+		applier{name: "sysctls", apply: ApplySysctls, plan: planSysctls},
+		applier{name: "environment", apply: ApplyEnvironment, plan: planEnvironment},
+		applier{name: "ssh_authorized_keys", apply: ApplySSHKeysWithNet},
+		applier{name: "k3s", apply: applyK3SLive(old), plan: planK3S(true, false)},
+	)
+}
+
+// applyK3SLive updates the labels and taints of the running node directly, and only restarts k3s
+// if any of its other arguments changed.
+func applyK3SLive(old *config.CloudConfig) func(cfg *config.CloudConfig) error {
+	return func(cfg *config.CloudConfig) error {
+		args, vars, ok, err := k3sInstall(cfg, true, false)
+		if err != nil || !ok {
+			return err
+		}
+		certs, err := caCertificates(cfg.K3OS.HTTP)
+		if err != nil {
+			return err
+		}
+		current, err := ioutil.ReadFile(statePath("k3s"))
+		if err == nil && withoutNodeArgs(string(current)) == withoutNodeArgs(k3sState(args, vars, certs)) {
+			if err := updateNode(old, cfg); err != nil {
+				return err
+			}
+			// update the service for the next start without restarting it
+			return ApplyK3S(cfg, false, false)
+		}
+		return ApplyK3S(cfg, true, false)
+	}
+}
+
+// withoutNodeArgs removes the labels and taints from a k3s state.
+func withoutNodeArgs(state string) string {
+	var result []string
+	items := strings.Split(state, "\n")
+	for i := 0; i < len(items); i++ {
+		if i+1 < len(items) && (items[i] == "--node-label" ||
+			items[i] == "--kubelet-arg" && strings.HasPrefix(items[i+1], "register-with-taints=")) {
+			i++
+			continue
+		}
+		result = append(result, items[i])
+	}
+	return strings.Join(result, "\n")
+}
+
+func updateNode(old, cfg *config.CloudConfig) error {
+	node, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	var labels []string
+	for k := range old.K3OS.Labels {
+		if _, ok := cfg.K3OS.Labels[k]; !ok {
+			labels = append(labels, k+"-")
+		}
+	}
+	for k, v := range cfg.K3OS.Labels {
+		if old.K3OS.Labels[k] != v {
+			labels = append(labels, k+"="+v)
+		}
+	}
+	if err := kubectl(append([]string{"label", "node", node, "--overwrite"}, labels...)...); err != nil {
+		return err
+	}
+
+	var taints []string
+	for _, t := range old.K3OS.Taints {
+		if !contains(cfg.K3OS.Taints, t) {
+			taints = append(taints, t+"-")
+		}
+	}
+	for _, t := range cfg.K3OS.Taints {
+		if !contains(old.K3OS.Taints, t) {
+			taints = append(taints, t)
+		}
+	}
+	return kubectl(append([]string{"taint", "node", node, "--overwrite"}, taints...)...)
+}
+
+func kubectl(args ...string) error {
+	// nothing to change
+	if len(args) == 4 {
+		return nil
+	}
+	cmd := exec.Command("k3s", append([]string{"kubectl"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	logrus.Debugf("Running %s %v", cmd.Path, cmd.Args)
+	return cmd.Run()
+}
+
+type inotifyEvent struct {
+	wd   int32
+	name string
+}
+
+func addWatches(fd int, dirs map[int32]string) {
+	for _, dir := range config.WatchPaths() {
+		wd, err := unix.InotifyAddWatch(fd, dir, watchEvents)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logrus.Warnf("failed to watch %s: %v", dir, err)
+			}
+			continue
+		}
+		dirs[int32(wd)] = dir
+	}
+}
+
+func readEvents(fd int, events chan<- inotifyEvent, errs chan<- error) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			errs <- err
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			events <- inotifyEvent{
+				wd:   event.Wd,
+				name: string(bytes.TrimRight(name, "\x00")),
+			}
+		}
+	}
+}
+
+func jsonString(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
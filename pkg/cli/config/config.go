@@ -3,7 +3,11 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/rancher/k3os/pkg/cc"
 	"github.com/rancher/k3os/pkg/config"
@@ -17,6 +21,9 @@ var (
 	installPhase = false
 	dump         = false
 	dumpJSON     = false
+	explain      = false
+	showSecrets  = false
+	dryRun       = false
 )
 
 // Command `config`
@@ -44,49 +51,209 @@ func Command() cli.Command {
 				Destination: &installPhase,
 				Usage:       "Run install stage",
 			},
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Destination: &dryRun,
+				Usage:       "Print the changes a stage would make as a diff, without making them",
+			},
 			cli.BoolFlag{
 				Name:        "dump",
 				Destination: &dump,
 				Usage:       "Print current configuration",
 			},
+			cli.BoolFlag{
+				Name:        "explain",
+				Destination: &explain,
+				Usage:       "With --dump, print the source of each configuration key",
+			},
+			cli.BoolFlag{
+				Name:        "show-secrets",
+				Destination: &showSecrets,
+				Usage:       "With --dump or --dump-json, print secrets instead of redacting them",
+			},
 			cli.BoolFlag{
 				Name:        "dump-json",
 				Destination: &dumpJSON,
 				Usage:       "Print current configuration in json",
 			},
 		},
-		Before: func(c *cli.Context) error {
-			if os.Getuid() != 0 {
-				return fmt.Errorf("must be run as root")
-			}
-			return nil
-		},
-		Action: func(*cli.Context) {
+		Action: func(*cli.Context) error {
 			if err := Main(); err != nil {
 				logrus.Error(err)
+				if _, ok := err.(*cc.FatalError); ok {
+					return cli.NewExitError("", 2)
+				}
+				return cli.NewExitError("", 1)
 			}
+			return nil
+		},
+		Subcommands: []cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "validate cloud-config files",
+				ArgsUsage: "[FILE...]",
+				Action:    Validate,
+			},
+			{
+				Name:      "encrypt",
+				Usage:     "encrypt a secret for use in config.yaml",
+				ArgsUsage: "[VALUE]",
+				Before:    requireRoot,
+				Action:    Encrypt,
+			},
+			{
+				Name:   "watch",
+				Usage:  "apply the runtime-safe parts of the config whenever it changes",
+				Before: requireRoot,
+				Action: func(*cli.Context) error {
+					return cc.Watch()
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "print the result of the last configuration phase",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the report in json",
+					},
+				},
+				Action: Status,
+			},
 		},
 	}
 }
 
 // Main `config`
 func Main() error {
-	cfg, err := config.ReadConfig()
-	if err != nil {
+	if err := requireRoot(nil); err != nil {
 		return err
 	}
 
+	if dump && explain {
+		_, provenance, err := config.ReadConfigWithProvenance()
+		if err != nil {
+			return err
+		}
+		if !showSecrets {
+			provenance.Redact()
+		}
+		return config.WriteProvenance(provenance, os.Stdout)
+	}
+
+	read := config.ReadConfig
 	if initrd {
+		// the secret key is not available before the local state is
+		read = config.ReadInitrdConfig
+	}
+	cfg, err := read()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		phase := "runtime"
+		if initrd {
+			phase = "initrd"
+		} else if bootPhase {
+			phase = "boot"
+		} else if installPhase {
+			phase = "install"
+		}
+		return cc.DryRun(os.Stdout, phase, &cfg)
+	} else if initrd {
 		return cc.InitApply(&cfg)
 	} else if bootPhase {
 		return cc.BootApply(&cfg)
 	} else if installPhase {
 		return cc.InstallApply(&cfg)
-	} else if dump {
+	} else if dump || dumpJSON {
+		if !showSecrets {
+			cfg = config.Redact(cfg)
+		}
+		if dumpJSON {
+			return json.NewEncoder(os.Stdout).Encode(&cfg)
+		}
 		return config.Write(cfg, os.Stdout)
-	} else if dumpJSON {
-		return json.NewEncoder(os.Stdout).Encode(&cfg)
 	}
 
 	return cc.RunApply(&cfg)
 }
+
+// Validate `config validate`
+func Validate(c *cli.Context) error {
+	files := c.Args()
+	if len(files) == 0 {
+		paths, err := config.Paths()
+		if err != nil {
+			return err
+		}
+		files = paths
+	}
+
+	count := 0
+	for _, file := range files {
+		problems, err := config.ValidateFile(file)
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		count += len(problems)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("found %d problem(s) in %d file(s)", count, len(files))
+	}
+	return nil
+}
+
+// Encrypt `config encrypt`
+func Encrypt(c *cli.Context) error {
+	value := c.Args().First()
+	if value == "" {
+		bytes, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimRight(string(bytes), "\r\n")
+	}
+
+	secret, err := config.Encrypt(value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(secret)
+	return nil
+}
+
+// Status `config status`
+func Status(c *cli.Context) error {
+	report, err := cc.LastReport()
+	if err != nil {
+		return err
+	}
+	if report == nil {
+		return fmt.Errorf("no report found in %s", cc.ReportDir())
+	}
+
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+
+	fmt.Printf("phase %s started %s, %d of %d failed\n", report.Phase, report.Started.Format(time.RFC3339), report.Failed(), len(report.Results))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tDURATION\tERROR")
+	for _, r := range report.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, r.Status, time.Duration(r.DurationMS)*time.Millisecond, r.Error)
+	}
+	return w.Flush()
+}
+
+func requireRoot(*cli.Context) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("must be run as root")
+	}
+	return nil
+}
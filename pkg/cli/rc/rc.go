@@ -12,6 +12,9 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/module"
+	"github.com/rancher/k3os/pkg/netconf"
 	"github.com/urfave/cli"
 	"golang.org/x/sys/unix"
 )
@@ -29,6 +32,7 @@ func Command() cli.Command {
 		},
 		Action: func(*cli.Context) {
 			doMounts()
+			doModprobe()
 			doHotplug()
 			doClock()
 			doLoopback()
@@ -251,6 +255,29 @@ func doMounts() {
 	mount("", "/", "", rec|shared, "")
 }
 
+// the options and blacklist of k3os.modules have to be in place before cold plug loads any modules
+func doModprobe() {
+	// the templates of the config need the network interfaces, which are not there before cold plug
+	cfg, err := config.ReadRawConfig()
+	if err != nil {
+		log.Printf("Failed to read config for %s: %v", module.ModprobeConfig, err)
+		return
+	}
+	// modules with templates are configured by the boot phase, once the templates can be expanded
+	var modules []config.Module
+	for _, m := range cfg.K3OS.Modules {
+		if strings.Contains(m.Name+m.Options+m.Softdep, "{{") {
+			log.Printf("Leaving module %s with a template to the boot phase", m.Name)
+			continue
+		}
+		modules = append(modules, m)
+	}
+	cfg.K3OS.Modules = modules
+	if err := module.WriteConfig(&cfg); err != nil {
+		log.Printf("Failed to write %s: %v", module.ModprobeConfig, err)
+	}
+}
+
 func doHotplug() {
 	mdev := "/usr/sbin/mdev"
 	// start mdev for hotplug
@@ -295,13 +322,9 @@ func doResolvConf() {
 }
 
 func doLoopback() {
-	// TODO use netlink instead
-	cmd := exec.Command("/sbin/ip", "addr", "add", "127.0.0.1/8", "dev", "lo", "brd", "+", "scope", "host")
-	_ = cmd.Run()
-	cmd = exec.Command("/sbin/ip", "route", "add", "127.0.0.0/8", "dev", "lo", "scope", "host")
-	_ = cmd.Run()
-	cmd = exec.Command("/sbin/ip", "link", "set", "lo", "up")
-	_ = cmd.Run()
+	if err := netconf.Loopback(); err != nil {
+		log.Printf("Configuring loopback failed: %v", err)
+	}
 }
 
 func doHostname() {
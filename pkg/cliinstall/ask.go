@@ -173,6 +173,12 @@ func AskPassword(cfg *config.CloudConfig) error {
 	if len(cfg.SSHAuthorizedKeys) > 0 || cfg.K3OS.Password != "" {
 		return nil
 	}
+	// rancher does not need a password when there are other users to log in as
+	for _, u := range cfg.Users {
+		if len(u.SSHAuthorizedKeys) > 0 || u.Password != "" && !u.LockPassword {
+			return nil
+		}
+	}
 
 	var (
 		ok   = false
@@ -266,6 +272,12 @@ func AskGithub(cfg *config.CloudConfig) error {
 	if len(cfg.SSHAuthorizedKeys) > 0 || cfg.K3OS.Password != "" {
 		return nil
 	}
+	// rancher does not need a password when there are other users to log in as
+	for _, u := range cfg.Users {
+		if len(u.SSHAuthorizedKeys) > 0 || u.Password != "" && !u.LockPassword {
+			return nil
+		}
+	}
 
 	ok, err := questions.PromptBool("Authorize GitHub users to SSH?", false)
 	if !ok || err != nil {
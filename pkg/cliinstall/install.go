@@ -14,7 +14,8 @@ import (
 func Run() error {
 	fmt.Println("\nRunning k3OS configuration")
 
-	cfg, err := config.ReadConfig()
+	// the config is written out again, its secrets must stay encrypted
+	cfg, err := config.ReadEncryptedConfig()
 	if err != nil {
 		return err
 	}
@@ -92,6 +93,17 @@ func runInstall(cfg config.CloudConfig) error {
 	if err != nil {
 		return err
 	}
+	// the installed system needs the secret key to decrypt the secrets of the config
+	for _, key := range []struct {
+		name, path string
+	}{
+		{"K3OS_INSTALL_SECRET_KEY", config.SecretKey},
+		{"K3OS_INSTALL_SEALED_SECRET_KEY", config.SealedSecretKey},
+	} {
+		if _, err := os.Stat(key.path); err == nil {
+			ev = append(ev, key.name+"="+key.path)
+		}
+	}
 
 	if tempFile != nil {
 		cfg.K3OS.Install = nil
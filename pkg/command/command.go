@@ -23,7 +23,7 @@ func ExecuteCommand(commands []string) error {
 	return nil
 }
 
-func SetPassword(password string) error {
+func SetPassword(username, password string) error {
 	if password == "" {
 		return nil
 	}
@@ -31,7 +31,7 @@ func SetPassword(password string) error {
 	if strings.HasPrefix(password, "$") {
 		cmd.Args = append(cmd.Args, "-e")
 	}
-	cmd.Stdin = strings.NewReader(fmt.Sprint("rancher:", password))
+	cmd.Stdin = strings.NewReader(fmt.Sprint(username, ":", password))
 	cmd.Stdout = os.Stdout
 	errBuffer := &bytes.Buffer{}
 	cmd.Stderr = errBuffer
@@ -0,0 +1,319 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/definition"
+	"github.com/rancher/mapper/values"
+	"github.com/sirupsen/logrus"
+)
+
+// cmdlineParam is a single parameter of the kernel cmdline, e.g.
+//
+//	k3os.token=secret               set a value
+//	k3os.dns_nameservers=8.8.8.8    repeated, append to a list
+//	k3os.k3s_args[]=server          append to a list
+//	k3os.labels["a.io/zone"]=a      key segment containing dots
+//	k3os.labels.a.io/zone=a         the same, below a map every dot is part of the map key
+//	k3os.taints=                    clear a value, list or map
+//	k3os.install.silent             a bare flag is true
+//	"k3os.password=two words"       quoted parameter, or value
+type cmdlineParam struct {
+	// token is the parameter as written on the cmdline
+	token    string
+	keys     []string
+	value    string
+	hasValue bool
+	append   bool
+}
+
+func readCmdline() (map[string]interface{}, error) {
+	bytes, err := ioutil.ReadFile(cmdline)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	params, errs := parseCmdline(string(bytes))
+	for _, err := range errs {
+		logrus.Warnf("ignoring kernel cmdline parameter: %v", err)
+	}
+	return cmdlineToData(params), nil
+}
+
+// cmdlineToData builds config data from cmdline parameters, typing values by the schema field they set.
+func cmdlineToData(params []cmdlineParam) map[string]interface{} {
+	data := map[string]interface{}{}
+	for _, p := range params {
+		keys, field, known := cmdlineField(p.keys)
+		existing, exists := values.GetValue(data, keys...)
+
+		switch {
+		case known && definition.IsArrayType(field.Type):
+			list, _ := existing.([]string)
+			if p.hasValue && p.value == "" && !p.append {
+				list = []string{}
+			} else {
+				list = append(list, p.cmdlineValue())
+			}
+			values.PutValue(data, list, keys...)
+		case known && field.Type == "map[string]" && p.hasValue && p.value == "":
+			values.PutValue(data, map[string]interface{}{}, keys...)
+		case known && field.Type == "boolean" && p.hasValue && p.value == "":
+			values.PutValue(data, "false", keys...)
+		case known || !exists:
+			values.PutValue(data, p.cmdlineValue(), keys...)
+		default:
+			// parameters that are not part of the config keep all their values
+			switch v := existing.(type) {
+			case string:
+				values.PutValue(data, []string{v, p.cmdlineValue()}, keys...)
+			case []string:
+				values.PutValue(data, append(v, p.cmdlineValue()), keys...)
+			}
+		}
+	}
+	return data
+}
+
+func (p cmdlineParam) cmdlineValue() string {
+	if !p.hasValue {
+		return "true"
+	}
+	return p.value
+}
+
+// cmdlineField finds the schema field that keys refer to. Below a map field the remaining keys are
+// joined into a single map key, so that map keys may contain dots.
+func cmdlineField(keys []string) ([]string, mapper.Field, bool) {
+	s := schema
+	for i, k := range keys {
+		if s == nil {
+			break
+		}
+		name, ok := fieldName(s, k)
+		if !ok {
+			break
+		}
+		field := s.ResourceFields[name]
+		if i == len(keys)-1 {
+			return keys, field, true
+		}
+		if field.Type == "map[string]" {
+			result := append(append([]string{}, keys[:i+1]...), strings.Join(keys[i+1:], "."))
+			return result, mapper.Field{Type: "string"}, true
+		}
+		if definition.IsArrayType(field.Type) {
+			break
+		}
+		s = schemas.Schema(field.Type)
+	}
+	return keys, mapper.Field{}, false
+}
+
+// parseCmdline splits the kernel cmdline into parameters, returning an error for each malformed one.
+func parseCmdline(line string) ([]cmdlineParam, []error) {
+	var (
+		params []cmdlineParam
+		errs   []error
+	)
+	for _, token := range cmdlineTokens(line) {
+		p, err := parseCmdlineParam(token)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		params = append(params, p)
+	}
+	return params, errs
+}
+
+// cmdlineTokens splits line on whitespace outside of double quotes.
+func cmdlineTokens(line string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func parseCmdlineParam(token string) (cmdlineParam, error) {
+	p := cmdlineParam{token: token}
+	s := []rune(token)
+	// the kernel allows the whole parameter to be quoted
+	if len(s) > 1 && s[0] == '"' && s[len(s)-1] == '"' && !strings.ContainsRune(string(s[1:len(s)-1]), '"') {
+		s = s[1 : len(s)-1]
+	}
+
+	keys, appendTo, i, err := parseCmdlineKey(s)
+	if err != nil {
+		return p, fmt.Errorf("%s: %v", token, err)
+	}
+	p.keys, p.append = keys, appendTo
+
+	if i < len(s) {
+		p.hasValue = true
+		if p.value, err = cmdlineParamValue(s[i+1:]); err != nil {
+			return p, fmt.Errorf("%s: %v", token, err)
+		}
+	}
+	return p, nil
+}
+
+// parseCmdlineKey reads the key at the start of s, up to the = or the end of s, returning the segments
+// of the key, whether it ends with [] and the number of runes read.
+func parseCmdlineKey(s []rune) ([]string, bool, int, error) {
+	var keys []string
+	i := 0
+	for {
+		segment, n, err := cmdlineSegment(s[i:])
+		if err != nil {
+			return nil, false, 0, err
+		}
+		if n == 0 && (i == 0 || s[i-1] == '.') {
+			return nil, false, 0, fmt.Errorf("empty key segment")
+		}
+		if n > 0 {
+			keys = append(keys, segment)
+		}
+		i += n
+
+		for i < len(s) && s[i] == '[' {
+			if i+1 < len(s) && s[i+1] == ']' {
+				i += 2
+				if i < len(s) && s[i] != '=' {
+					return nil, false, 0, fmt.Errorf("[] must be the end of the key")
+				}
+				return keys, true, i, nil
+			}
+			index, n, err := cmdlineIndex(s[i+1:])
+			if err != nil {
+				return nil, false, 0, err
+			}
+			keys = append(keys, index)
+			i += 1 + n
+		}
+
+		switch {
+		case i >= len(s) || s[i] == '=':
+			return keys, false, i, nil
+		case s[i] == '.':
+			i++
+		default:
+			return nil, false, 0, fmt.Errorf("expected . or = after ]")
+		}
+	}
+}
+
+// cmdlineSegment reads a key segment, up to the next ., [ or =.
+func cmdlineSegment(s []rune) (string, int, error) {
+	var segment strings.Builder
+	i := 0
+	for i < len(s) {
+		switch s[i] {
+		case '.', '[', '=':
+			return segment.String(), i, nil
+		case '"':
+			value, n, err := unquote(s[i:])
+			if err != nil {
+				return "", 0, err
+			}
+			segment.WriteString(value)
+			i += n
+		default:
+			segment.WriteRune(s[i])
+			i++
+		}
+	}
+	return segment.String(), i, nil
+}
+
+// cmdlineIndex reads a bracketed key segment, after the [ and up to and including the ].
+func cmdlineIndex(s []rune) (string, int, error) {
+	if len(s) > 0 && s[0] == '"' {
+		value, n, err := unquote(s)
+		if err != nil {
+			return "", 0, err
+		}
+		if n >= len(s) || s[n] != ']' {
+			return "", 0, fmt.Errorf("missing ]")
+		}
+		return value, n + 1, nil
+	}
+	for i, r := range s {
+		if r == ']' {
+			return string(s[:i]), i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("missing ]")
+}
+
+// cmdlineParamValue removes the quotes from a value, where a backslash escapes the next character.
+func cmdlineParamValue(s []rune) (string, error) {
+	var (
+		value  strings.Builder
+		quoted bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\' && i+1 < len(s):
+			i++
+			value.WriteRune(s[i])
+		case s[i] == '"':
+			quoted = !quoted
+		default:
+			value.WriteRune(s[i])
+		}
+	}
+	if quoted {
+		return "", fmt.Errorf("unterminated quote")
+	}
+	return value.String(), nil
+}
+
+// unquote reads the quoted string at the start of s, returning it and the number of runes read.
+func unquote(s []rune) (string, int, error) {
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				value.WriteRune(s[i])
+			}
+		case '"':
+			return value.String(), i + 1, nil
+		default:
+			value.WriteRune(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quote")
+}
@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzCmdline(f *testing.F) {
+	for _, seed := range []string{
+		`BOOT_IMAGE=/vmlinuz k3os.mode=local rescue`,
+		`"k3os.password=two words" k3os.token="a b"`,
+		`k3os.labels["topology.kubernetes.io/zone"]=a k3os.labels.x.y=b`,
+		`k3os.k3s_args[]=server k3os.taints= k3os.install.silent`,
+		`k3os.labels["x\"y"]="a\\b"`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		params, _ := parseCmdline(line)
+		for _, p := range params {
+			// every parameter can be written again and reads back the same
+			again, errs := parseCmdline(formatCmdlineParam(p))
+			if len(errs) > 0 || len(again) != 1 {
+				t.Fatalf("%q formatted as %q: %v", p.token, formatCmdlineParam(p), errs)
+			}
+			again[0].token = p.token
+			if !reflect.DeepEqual(again[0], p) {
+				t.Fatalf("%q formatted as %q: got %+v, expected %+v", p.token, formatCmdlineParam(p), again[0], p)
+			}
+		}
+		// building the config data must never panic
+		cmdlineToData(params)
+	})
+}
+
+func formatCmdlineParam(p cmdlineParam) string {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+
+	// the leading empty quotes keep the parameter from being read as a quoted parameter
+	var b strings.Builder
+	b.WriteString(`""`)
+	for i, k := range p.keys {
+		if i == 0 {
+			b.WriteString(quote(k))
+			continue
+		}
+		b.WriteString("[")
+		b.WriteString(quote(k))
+		b.WriteString("]")
+	}
+	if p.append {
+		b.WriteString("[]")
+	}
+	if p.hasValue {
+		b.WriteString("=")
+		b.WriteString(quote(p.value))
+	}
+	return b.String()
+}
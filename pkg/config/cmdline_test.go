@@ -0,0 +1,138 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCmdline(t *testing.T) {
+	tests := []struct {
+		line   string
+		params []cmdlineParam
+		errors int
+	}{
+		{
+			line: `BOOT_IMAGE=/vmlinuz k3os.mode=local rescue`,
+			params: []cmdlineParam{
+				{token: "BOOT_IMAGE=/vmlinuz", keys: []string{"BOOT_IMAGE"}, value: "/vmlinuz", hasValue: true},
+				{token: "k3os.mode=local", keys: []string{"k3os", "mode"}, value: "local", hasValue: true},
+				{token: "rescue", keys: []string{"rescue"}},
+			},
+		},
+		{
+			line: `"k3os.password=two words" k3os.token="a b" k3os.labels.x="say \"hi\""`,
+			params: []cmdlineParam{
+				{token: `"k3os.password=two words"`, keys: []string{"k3os", "password"}, value: "two words", hasValue: true},
+				{token: `k3os.token="a b"`, keys: []string{"k3os", "token"}, value: "a b", hasValue: true},
+				{token: `k3os.labels.x="say \"hi\""`, keys: []string{"k3os", "labels", "x"}, value: `say "hi"`, hasValue: true},
+			},
+		},
+		{
+			line: `k3os.labels["topology.kubernetes.io/zone"]=a k3os.labels[rack].x=1 k3os.labels."a.b"=c`,
+			params: []cmdlineParam{
+				{token: `k3os.labels["topology.kubernetes.io/zone"]=a`, keys: []string{"k3os", "labels", "topology.kubernetes.io/zone"}, value: "a", hasValue: true},
+				{token: `k3os.labels[rack].x=1`, keys: []string{"k3os", "labels", "rack", "x"}, value: "1", hasValue: true},
+				{token: `k3os.labels."a.b"=c`, keys: []string{"k3os", "labels", "a.b"}, value: "c", hasValue: true},
+			},
+		},
+		{
+			line: `k3os.k3s_args[]=server k3os.taints=`,
+			params: []cmdlineParam{
+				{token: "k3os.k3s_args[]=server", keys: []string{"k3os", "k3s_args"}, value: "server", hasValue: true, append: true},
+				{token: "k3os.taints=", keys: []string{"k3os", "taints"}, hasValue: true},
+			},
+		},
+		{
+			line:   `=a k3os..token=a k3os.labels["x"=a k3os.labels[x]y=a k3os.k3s_args[]x=a k3os.token="a`,
+			errors: 6,
+		},
+	}
+
+	for _, tt := range tests {
+		params, errs := parseCmdline(tt.line)
+		if len(errs) != tt.errors {
+			t.Errorf("%s: got errors %v, expected %d", tt.line, errs, tt.errors)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s: got %+v, expected %+v", tt.line, params, tt.params)
+		}
+	}
+}
+
+func TestCmdlineConfig(t *testing.T) {
+	tests := []struct {
+		line  string
+		check func(cc CloudConfig) bool
+	}{
+		{
+			line: `k3os.labels.topology.kubernetes.io/zone=a k3os.labels["node.io/rack"]=1`,
+			check: func(cc CloudConfig) bool {
+				return reflect.DeepEqual(cc.K3OS.Labels, map[string]string{"topology.kubernetes.io/zone": "a", "node.io/rack": "1"})
+			},
+		},
+		{
+			line: `k3os.dns_nameservers=1.1.1.1 k3os.dns_nameservers=8.8.8.8 k3os.k3s_args[]=server`,
+			check: func(cc CloudConfig) bool {
+				return reflect.DeepEqual(cc.K3OS.DNSNameservers, []string{"1.1.1.1", "8.8.8.8"}) &&
+					reflect.DeepEqual(cc.K3OS.K3sArgs, []string{"server"})
+			},
+		},
+		{
+			line: `k3os.taints=a k3os.taints= k3os.taints[]=b`,
+			check: func(cc CloudConfig) bool {
+				return reflect.DeepEqual(cc.K3OS.Taints, []string{"b"})
+			},
+		},
+		{
+			line: `k3os.install.silent k3os.install.power_off=false k3os.install.debug=true k3os.install.debug=`,
+			check: func(cc CloudConfig) bool {
+				return cc.K3OS.Install != nil && cc.K3OS.Install.Silent && !cc.K3OS.Install.PowerOff && !cc.K3OS.Install.Debug
+			},
+		},
+		{
+			line: `hostname=a hostname=b`,
+			check: func(cc CloudConfig) bool {
+				return cc.Hostname == "b"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		params, errs := parseCmdline(tt.line)
+		if len(errs) > 0 {
+			t.Fatalf("%s: %v", tt.line, errs)
+		}
+		cc, err := readersToObject(func() (map[string]interface{}, error) {
+			return cmdlineToData(params), nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.line, err)
+		}
+		if !tt.check(cc) {
+			t.Errorf("%s: got %+v", tt.line, cc)
+		}
+	}
+}
+
+func TestCmdlineClear(t *testing.T) {
+	params, _ := parseCmdline(`k3os.taints= k3os.labels=`)
+	cc, err := readersToObject(
+		func() (map[string]interface{}, error) {
+			return map[string]interface{}{
+				"k3os": map[string]interface{}{
+					"taints": []interface{}{"key1=value1:NoSchedule"},
+					"labels": map[string]interface{}{"region": "us-west-1"},
+				},
+			}, nil
+		},
+		func() (map[string]interface{}, error) {
+			return cmdlineToData(params), nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.K3OS.Taints) != 0 || len(cc.K3OS.Labels) != 0 {
+		t.Fatalf("got taints %v and labels %v, expected them to be cleared", cc.K3OS.Taints, cc.K3OS.Labels)
+	}
+}
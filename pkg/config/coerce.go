@@ -1,6 +1,8 @@
 package config
 
 import (
+	"strings"
+
 	"github.com/rancher/mapper"
 	"github.com/rancher/mapper/convert"
 	"github.com/rancher/mapper/mappers"
@@ -75,6 +77,32 @@ func NewToSlice() mapper.Mapper {
 	})
 }
 
+// NewToModules reads the k3os.modules entries given as "name options..." strings as modules to load.
+func NewToModules() mapper.Mapper {
+	return NewTypeConverter("array[module]", func(val interface{}) interface{} {
+		if str, ok := val.(string); ok {
+			val = []interface{}{str}
+		}
+		list, ok := val.([]interface{})
+		if !ok {
+			return val
+		}
+		result := make([]interface{}, len(list))
+		for i, entry := range list {
+			result[i] = entry
+			if str, ok := entry.(string); ok {
+				fields := strings.SplitN(strings.TrimSpace(str), " ", 2)
+				m := map[string]interface{}{"name": fields[0]}
+				if len(fields) > 1 {
+					m["options"] = strings.TrimSpace(fields[1])
+				}
+				result[i] = m
+			}
+		}
+		return result
+	})
+}
+
 func NewToBool() mapper.Mapper {
 	return NewTypeConverter("boolean", func(val interface{}) interface{} {
 		if str, ok := val.(string); ok {
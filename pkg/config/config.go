@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+
+	"github.com/sirupsen/logrus"
 )
 
 type K3OS struct {
 	DataSources    []string          `json:"dataSources,omitempty"`
-	Modules        []string          `json:"modules,omitempty"`
+	Modules        []Module          `json:"modules,omitempty"`
 	Sysctls        map[string]string `json:"sysctls,omitempty"`
 	NTPServers     []string          `json:"ntpServers,omitempty"`
 	DNSNameservers []string          `json:"dnsNameservers,omitempty"`
@@ -21,11 +23,171 @@ type K3OS struct {
 	Environment    map[string]string `json:"environment,omitempty"`
 	Taints         []string          `json:"taints,omitempty"`
 	Install        *Install          `json:"install,omitempty"`
+	ApplyPolicy    map[string]string `json:"applyPolicy,omitempty"`
+	Network        *Network          `json:"network,omitempty"`
+	SSHKeyTimeout  string            `json:"sshKeyTimeout,omitempty"`
+	SSH            *SSH              `json:"ssh,omitempty"`
+	RemoteFiles    []RemoteFile      `json:"remoteFiles,omitempty"`
+	HTTP           *HTTP             `json:"http,omitempty"`
+	Watch          bool              `json:"watch,omitempty"`
+}
+
+// Module is a kernel module to load, or only to configure for when it is loaded by hotplug. An entry can
+// also be given as a string of the name followed by options, which loads the module with them.
+type Module struct {
+	Name string `json:"name,omitempty"`
+	// Options are the parameters of the module, e.g. "modeset=0"
+	Options string `json:"options,omitempty"`
+	// Load defaults to true, unless the module is blacklisted
+	Load      *bool `json:"load,omitempty"`
+	Blacklist bool  `json:"blacklist,omitempty"`
+	// Softdep is written as "softdep <name> <softdep>", e.g. "pre: crc32c"
+	Softdep string `json:"softdep,omitempty"`
+}
+
+// Policies for handling a failure of a configuration step, set by name in k3os.apply_policy.
+const (
+	// PolicyContinue records the failure and carries on, the command fails at the end
+	PolicyContinue = "continue"
+	// PolicyWarn records the failure as a warning, it does not fail the command
+	PolicyWarn = "warn"
+	// PolicyFatal stops at the failure, the remaining steps are skipped
+	PolicyFatal = "fatal"
+)
+
+// Steps are the names of the configuration steps of all phases, which k3os.apply_policy refers to. They
+// are set by pkg/cc, which defines the steps; apply_policy is not checked against them until then.
+var Steps []string
+
+// Policy returns the policy for a failure of the named configuration step. An unknown policy, which may
+// come from the kernel cmdline without having been validated, is taken as continue, with a warning.
+func (k *K3OS) Policy(name string) string {
+	switch policy := k.ApplyPolicy[name]; policy {
+	case PolicyWarn, PolicyFatal:
+		return policy
+	case "", PolicyContinue:
+	default:
+		logrus.Warnf("unknown apply_policy %q for step %s, using %s", policy, name, PolicyContinue)
+	}
+	return PolicyContinue
 }
 
 type Wifi struct {
-	Name       string `json:"name,omitempty"`
-	Passphrase string `json:"passphrase,omitempty"`
+	Name                 string   `json:"name,omitempty"`
+	Passphrase           string   `json:"passphrase,omitempty"`
+	Security             string   `json:"security,omitempty"`
+	EAP                  string   `json:"eap,omitempty"`
+	Identity             string   `json:"identity,omitempty"`
+	AnonymousIdentity    string   `json:"anonymousIdentity,omitempty"`
+	Phase2               string   `json:"phase2,omitempty"`
+	CACertFile           string   `json:"caCertFile,omitempty"`
+	ClientCertFile       string   `json:"clientCertFile,omitempty"`
+	PrivateKeyFile       string   `json:"privateKeyFile,omitempty"`
+	PrivateKeyPassphrase string   `json:"privateKeyPassphrase,omitempty"`
+	DomainSuffixMatch    string   `json:"domainSuffixMatch,omitempty"`
+	Hidden               bool     `json:"hidden,omitempty"`
+	Priority             int      `json:"priority,omitempty"` // ignored, connman does not prefer one network over another
+	Addresses            []string `json:"addresses,omitempty"`
+	Gateway              string   `json:"gateway,omitempty"`
+	Gateway6             string   `json:"gateway6,omitempty"`
+	Nameservers          []string `json:"nameservers,omitempty"`
+}
+
+// Network declares interfaces that k3OS configures itself, rather than leaving them to connman.
+type Network struct {
+	Interfaces []NetworkInterface `json:"interfaces,omitempty"`
+}
+
+// NetworkInterface is a physical interface, or a bond, VLAN or bridge that is created, in the order listed.
+type NetworkInterface struct {
+	Name string `json:"name,omitempty"`
+	// DHCP leaves the addresses of the interface to connman
+	DHCP      bool           `json:"dhcp,omitempty"`
+	Addresses []string       `json:"addresses,omitempty"`
+	Gateway   string         `json:"gateway,omitempty"`
+	Gateway6  string         `json:"gateway6,omitempty"`
+	Routes    []NetworkRoute `json:"routes,omitempty"`
+	MTU       int            `json:"mtu,omitempty"`
+	Bond      *NetworkBond   `json:"bond,omitempty"`
+	VLAN      *NetworkVLAN   `json:"vlan,omitempty"`
+	Bridge    *NetworkBridge `json:"bridge,omitempty"`
+}
+
+type NetworkRoute struct {
+	To     string `json:"to,omitempty"`
+	Via    string `json:"via,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+}
+
+type NetworkBond struct {
+	Mode   string   `json:"mode,omitempty"`
+	Slaves []string `json:"slaves,omitempty"`
+	// Options are written to /sys/class/net/<name>/bonding, e.g. miimon: "100"
+	Options map[string]string `json:"options,omitempty"`
+}
+
+type NetworkVLAN struct {
+	Link string `json:"link,omitempty"`
+	ID   int    `json:"id,omitempty"`
+}
+
+type NetworkBridge struct {
+	Ports []string `json:"ports,omitempty"`
+	STP   bool     `json:"stp,omitempty"`
+}
+
+// SSH configures sshd, in addition to the keys authorized for each user. Settings that are not set keep
+// the values of the shipped sshd_config.
+type SSH struct {
+	Port            int      `json:"port,omitempty"`
+	ListenAddresses []string `json:"listenAddresses,omitempty"`
+	// PasswordAuthentication allows or denies logging in with a password, the shipped config denies it
+	PasswordAuthentication *bool `json:"passwordAuthentication,omitempty"`
+	// PermitRootLogin is yes, no, prohibit-password or forced-commands-only
+	PermitRootLogin string   `json:"permitRootLogin,omitempty"`
+	Ciphers         []string `json:"ciphers,omitempty"`
+	MACs            []string `json:"macs,omitempty"`
+	KexAlgorithms   []string `json:"kexAlgorithms,omitempty"`
+	AllowUsers      []string `json:"allowUsers,omitempty"`
+	// TrustedUserCAKeys are the public keys of the CAs whose user certificates are accepted
+	TrustedUserCAKeys []string     `json:"trustedUserCaKeys,omitempty"`
+	HostKeys          []SSHHostKey `json:"hostKeys,omitempty"`
+}
+
+// SSHHostKey replaces the host key of a type, or only adds a certificate to the generated one when Key is empty.
+type SSHHostKey struct {
+	// Type is rsa, ecdsa or ed25519
+	Type        string `json:"type,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// RemoteFile is downloaded to Path, and cached so that it can be put back in place without the network.
+type RemoteFile struct {
+	URL                string `json:"url,omitempty"`
+	Path               string `json:"path,omitempty"`
+	RawFilePermissions string `json:"permissions,omitempty"`
+	// SHA256 is the hex encoded sha256 that the download must have
+	SHA256 string `json:"sha256,omitempty"`
+	// AuthHeaderFile holds a header to send with the request, e.g. "Authorization: Bearer <token>"
+	AuthHeaderFile string `json:"authHeaderFile,omitempty"`
+}
+
+// HTTP configures the client that k3OS downloads with, and the environment of k3s-install.sh.
+type HTTP struct {
+	HTTPProxy  string `json:"httpProxy,omitempty"`
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	// NoProxy are the hosts, domains and CIDRs that are reached without the proxy
+	NoProxy []string `json:"noProxy,omitempty"`
+	// CABundle is a file of PEM certificates trusted in addition to the system roots
+	CABundle string `json:"caBundle,omitempty"`
+	// CACerts are PEM certificates trusted in addition to the system roots
+	CACerts string `json:"caCerts,omitempty"`
+	// Timeout bounds connecting and waiting for a response, not reading it, e.g. 30s
+	Timeout string `json:"timeout,omitempty"`
+	// Retries is how many times a failed download is retried, waiting RetryDelay, doubled each time
+	Retries    int    `json:"retries,omitempty"`
+	RetryDelay string `json:"retryDelay,omitempty"`
 }
 
 type Install struct {
@@ -48,6 +210,32 @@ type CloudConfig struct {
 	Runcmd            []string `json:"runCmd,omitempty"`
 	Bootcmd           []string `json:"bootCmd,omitempty"`
 	Initcmd           []string `json:"initCmd,omitempty"`
+	Users             []User   `json:"users,omitempty"`
+	// SSHAuthorizedKeysMode is append, the default, or managed
+	SSHAuthorizedKeysMode string `json:"sshAuthorizedKeysMode,omitempty"`
+	// SSHAuthorizedPrincipals are the certificate principals accepted for rancher
+	SSHAuthorizedPrincipals []string `json:"sshAuthorizedPrincipals,omitempty"`
+}
+
+const (
+	SSHKeysAppend  = "append"
+	SSHKeysManaged = "managed"
+)
+
+// User is an account created in addition to rancher, with a group of the same name.
+type User struct {
+	Name              string   `json:"name,omitempty"`
+	UID               int      `json:"uid,omitempty"`
+	GID               int      `json:"gid,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Shell             string   `json:"shell,omitempty"`
+	HomeDir           string   `json:"homeDir,omitempty"`
+	Sudo              bool     `json:"sudo,omitempty"`
+	Password          string   `json:"password,omitempty"`
+	LockPassword      bool     `json:"lockPassword,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	// SSHAuthorizedPrincipals are the certificate principals accepted for the user
+	SSHAuthorizedPrincipals []string `json:"sshAuthorizedPrincipals,omitempty"`
 }
 
 type File struct {
@@ -56,16 +244,44 @@ type File struct {
 	Owner              string `json:"owner"`
 	Path               string `json:"path"`
 	RawFilePermissions string `json:"permissions"`
+	// Append adds the content to the end of the file, unless the file already ends with it
+	Append bool `json:"append,omitempty"`
+	// Defer writes the file at the end of the phase, once users have been created and k3s installed
+	Defer bool `json:"defer,omitempty"`
+	// LinkTarget makes the file a symbolic link to it, instead of writing any content
+	LinkTarget string `json:"linkTarget,omitempty"`
+	// RawDirectoryPermissions and DirectoryOwner are given to the parent directories created for the file
+	RawDirectoryPermissions string      `json:"directoryPermissions,omitempty"`
+	DirectoryOwner          string      `json:"directoryOwner,omitempty"`
+	Source                  *FileSource `json:"source,omitempty"`
+	// SHA256 is the hex encoded sha256 that the decoded content must have
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// FileSource is a URL that the content of a file is fetched from, instead of being given in the config.
+type FileSource struct {
+	URL string `json:"url,omitempty"`
+	// SHA256 is the hex encoded sha256 that the fetched content must have
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 func (f *File) Permissions() (os.FileMode, error) {
-	if f.RawFilePermissions == "" {
-		return os.FileMode(0644), nil
+	return parsePermissions(f.RawFilePermissions, 0644)
+}
+
+// DirectoryPermissions returns the mode of the parent directories created for the file.
+func (f *File) DirectoryPermissions() (os.FileMode, error) {
+	return parsePermissions(f.RawDirectoryPermissions, 0755)
+}
+
+func parsePermissions(raw string, defaultPerm os.FileMode) (os.FileMode, error) {
+	if raw == "" {
+		return defaultPerm, nil
 	}
 	// parse string representation of file mode as integer
-	perm, err := strconv.ParseInt(f.RawFilePermissions, 8, 32)
+	perm, err := strconv.ParseInt(raw, 8, 32)
 	if err != nil {
-		return 0, fmt.Errorf("unable to parse file permissions %q as integer", f.RawFilePermissions)
+		return 0, fmt.Errorf("unable to parse file permissions %q as integer", raw)
 	}
 	return os.FileMode(perm), nil
 }
@@ -0,0 +1,32 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestPolicy(t *testing.T) {
+	var log bytes.Buffer
+	logrus.SetOutput(&log)
+	defer logrus.SetOutput(os.Stderr)
+
+	k := K3OS{ApplyPolicy: map[string]string{"modules": "fatal", "wifi": "warn", "k3s": "continue", "sysctls": "fata"}}
+	for name, expected := range map[string]string{
+		"modules":  PolicyFatal,
+		"wifi":     PolicyWarn,
+		"k3s":      PolicyContinue,
+		"hostname": PolicyContinue,
+		"sysctls":  PolicyContinue,
+	} {
+		if policy := k.Policy(name); policy != expected {
+			t.Errorf("%s: got %s, expected %s", name, policy, expected)
+		}
+	}
+	if warnings := strings.Count(log.String(), "level=warning"); warnings != 1 || !strings.Contains(log.String(), `unknown apply_policy \"fata\" for step sysctls`) {
+		t.Errorf("expected one warning for the policy of sysctls, got %s", log.String())
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+)
+
+// Difference is a key whose value differs between two configs.
+type Difference struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// Diff returns the keys that differ between two configs, sorted by key. Maps, such as k3os.labels,
+// are compared key by key, lists as a whole.
+func Diff(old, new CloudConfig) ([]Difference, error) {
+	a, err := convert.EncodeToMap(&old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := convert.EncodeToMap(&new)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Difference
+	diffValues(schema, "", a, b, &result)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+func diffValues(s *mapper.Schema, key string, a, b interface{}, result *[]Difference) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	// a map that is not set is compared as an empty one
+	if aok && b == nil || bok && a == nil {
+		aok, bok = true, true
+	}
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			*result = append(*result, Difference{Key: key, Old: a, New: b})
+		}
+		return
+	}
+
+	names := map[string]bool{}
+	for name := range am {
+		names[name] = true
+	}
+	for name := range bm {
+		names[name] = true
+	}
+	for name := range names {
+		if s == nil {
+			diffValues(nil, joinPath(key, name), am[name], bm[name], result)
+			continue
+		}
+		field := s.ResourceFields[name]
+		sub := schemas.Schema(field.Type)
+		if sub == nil && field.Type != "map[string]" || definition.IsArrayType(field.Type) {
+			if !reflect.DeepEqual(am[name], bm[name]) {
+				*result = append(*result, Difference{Key: joinPath(key, convert.ToYAMLKey(name)), Old: am[name], New: bm[name]})
+			}
+			continue
+		}
+		diffValues(sub, joinPath(key, convert.ToYAMLKey(name)), am[name], bm[name], result)
+	}
+}
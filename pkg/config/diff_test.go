@@ -0,0 +1,37 @@
+package config
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	old := CloudConfig{
+		Hostname: "one",
+		K3OS: K3OS{
+			Labels:  map[string]string{"region": "us-west-1", "zone": "a"},
+			K3sArgs: []string{"server"},
+		},
+	}
+	new := CloudConfig{
+		Hostname: "one",
+		K3OS: K3OS{
+			Labels:  map[string]string{"region": "us-west-1", "zone": "b", "rack": "1"},
+			K3sArgs: []string{"server", "--disable-agent"},
+		},
+	}
+
+	diffs, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"k3os.k3s_args", "k3os.labels.rack", "k3os.labels.zone"}
+	if len(diffs) != len(expected) {
+		t.Fatalf("got %v, expected changes to %v", diffs, expected)
+	}
+	for i, d := range diffs {
+		if d.Key != expected[i] {
+			t.Errorf("change %d: got key %s, expected %s", i, d.Key, expected[i])
+		}
+	}
+	if diffs[1].Old != nil || diffs[1].New != "1" {
+		t.Errorf("got %v, expected rack to be added", diffs[1])
+	}
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validate checks that the ways of giving the file are not mixed. The path, permissions and encoding
+// are checked by the validator itself, as their errors are reported at the key.
+func (f *File) Validate() error {
+	if f.LinkTarget != "" && (f.Content != "" || f.Source != nil || f.Append || f.SHA256 != "") {
+		return fmt.Errorf("link_target cannot be used with content, source, append or sha256")
+	}
+	if err := checkSHA256(f.SHA256); err != nil {
+		return err
+	}
+	if f.Source != nil && f.Source.SHA256 != "" && f.SHA256 != "" {
+		return fmt.Errorf("set either sha256 or source.sha256, not both")
+	}
+	if f.Source != nil {
+		if f.Content != "" || f.Encoding != "" {
+			return fmt.Errorf("source cannot be used with content or encoding")
+		}
+		u, err := url.Parse(f.Source.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("source needs an http or https url")
+		}
+		if err := checkSHA256(f.Source.SHA256); err != nil {
+			return fmt.Errorf("source: %v", err)
+		}
+	}
+	if perm, err := f.DirectoryPermissions(); err != nil {
+		return fmt.Errorf("directory_permissions: %v", err)
+	} else if perm&^07777 != 0 {
+		return fmt.Errorf("directory permissions %q out of range", f.RawDirectoryPermissions)
+	}
+	return nil
+}
+
+// ExpectedSHA256 returns the sha256 that the content of f must have, given as sha256 or, for a file
+// with a source, as source.sha256. It is lower case, as sha256 sums are formatted.
+func (f *File) ExpectedSHA256() string {
+	if f.SHA256 == "" && f.Source != nil {
+		return strings.ToLower(f.Source.SHA256)
+	}
+	return strings.ToLower(f.SHA256)
+}
+
+// VerifySHA256 checks that content has the sha256 of f, if it has one.
+func (f *File) VerifySHA256(content []byte) error {
+	want := f.ExpectedSHA256()
+	if want == "" {
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(content)); sum != want {
+		return fmt.Errorf("content has sha256 %s, expected %s", sum, want)
+	}
+	return nil
+}
+
+func checkSHA256(sum string) error {
+	if sum == "" {
+		return nil
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("invalid sha256 %q, expected 64 hex digits", sum)
+	}
+	return nil
+}
+
+func (r *RemoteFile) Permissions() (os.FileMode, error) {
+	return parsePermissions(r.RawFilePermissions, 0644)
+}
+
+// Validate checks that the file can be downloaded and written.
+func (r *RemoteFile) Validate() error {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, expected an http or https url", r.URL)
+	}
+	if !filepath.IsAbs(r.Path) {
+		return fmt.Errorf("path must be an absolute path")
+	}
+	if perm, err := r.Permissions(); err != nil {
+		return err
+	} else if perm&^07777 != 0 {
+		return fmt.Errorf("file permissions %q out of range", r.RawFilePermissions)
+	}
+	if r.AuthHeaderFile != "" && !filepath.IsAbs(r.AuthHeaderFile) {
+		return fmt.Errorf("auth_header_file must be an absolute path")
+	}
+	return checkSHA256(r.SHA256)
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rancher/k3os/pkg/util"
+)
+
+// Validate checks the proxies, durations and inline CA certificates. The CA bundle is only read when
+// the client is configured, it may not exist where the config is validated.
+func (h *HTTP) Validate() error {
+	for _, proxy := range []struct {
+		key, value string
+	}{
+		{"http_proxy", h.HTTPProxy},
+		{"https_proxy", h.HTTPSProxy},
+	} {
+		if proxy.value == "" {
+			continue
+		}
+		if _, err := util.ParseProxy(proxy.value); err != nil {
+			return fmt.Errorf("%s: %v", proxy.key, err)
+		}
+	}
+	for _, entry := range h.NoProxy {
+		if strings.ContainsAny(entry, " \t\n") {
+			return fmt.Errorf("invalid no_proxy entry %q", entry)
+		}
+	}
+	if h.CABundle != "" && !filepath.IsAbs(h.CABundle) {
+		return fmt.Errorf("ca_bundle must be an absolute path")
+	}
+	if h.CACerts != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(h.CACerts)) {
+		return fmt.Errorf("no PEM certificates in ca_certs")
+	}
+	for _, d := range []struct {
+		key, value string
+	}{
+		{"timeout", h.Timeout},
+		{"retry_delay", h.RetryDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(d.value); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid %s %q, expected e.g. 30s or 2m", d.key, d.value)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", h.Retries)
+	}
+	return nil
+}
+
+// Options returns the client options of k3os.http, which are the defaults if it is not set.
+func (h *HTTP) Options() (util.HTTPOptions, error) {
+	opts := util.HTTPOptions{
+		Timeout:    util.DefaultHTTPTimeout,
+		RetryDelay: util.DefaultHTTPRetryDelay,
+	}
+	if h == nil {
+		return opts, nil
+	}
+	if err := h.Validate(); err != nil {
+		return opts, err
+	}
+	certs, err := h.CACertificates()
+	if err != nil {
+		return opts, err
+	}
+	opts.HTTPProxy = h.HTTPProxy
+	opts.HTTPSProxy = h.HTTPSProxy
+	opts.NoProxy = h.NoProxy
+	opts.CACerts = certs
+	opts.Retries = h.Retries
+	if h.Timeout != "" {
+		opts.Timeout, _ = time.ParseDuration(h.Timeout)
+	}
+	if h.RetryDelay != "" {
+		opts.RetryDelay, _ = time.ParseDuration(h.RetryDelay)
+	}
+	return opts, nil
+}
+
+// CACertificates returns the PEM certificates of ca_bundle followed by those of ca_certs.
+func (h *HTTP) CACertificates() ([]byte, error) {
+	var certs []byte
+	if h.CABundle != "" {
+		bundle, err := ioutil.ReadFile(h.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_bundle: %v", err)
+		}
+		certs = append(certs, bundle...)
+	}
+	if h.CACerts != "" {
+		if len(certs) > 0 && certs[len(certs)-1] != '\n' {
+			certs = append(certs, '\n')
+		}
+		certs = append(certs, h.CACerts...)
+	}
+	return certs, nil
+}
+
+// NoProxyList returns no_proxy as the comma separated list of NO_PROXY.
+func (h *HTTP) NoProxyList() string {
+	var entries []string
+	for _, list := range h.NoProxy {
+		for _, entry := range strings.Split(list, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+	"github.com/rancher/mapper/values"
+)
+
+// mergeStrategyKey is the top-level key of a config file that chooses how the file's lists and maps
+// are merged with the config read before it, e.g.
+//
+//	merge_strategy:
+//	  ssh_authorized_keys: append
+//	  k3os.sysctls: merge
+//
+// Without a strategy, lists and maps replace any earlier value.
+const mergeStrategyKey = "merge_strategy"
+
+const (
+	mergeReplace = "replace"
+	mergeAppend  = "append"
+	mergePrepend = "prepend"
+	mergeMaps    = "merge"
+)
+
+// popMergeStrategies removes the merge strategy directive from data, returning it keyed by the
+// canonical key of each field.
+func popMergeStrategies(data map[string]interface{}) (map[string]string, error) {
+	raw, ok := data[mergeStrategyKey]
+	if !ok {
+		return nil, nil
+	}
+	delete(data, mergeStrategyKey)
+
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map of keys to strategies", mergeStrategyKey)
+	}
+
+	result := map[string]string{}
+	for key, strategy := range m {
+		if _, _, err := checkMergeStrategy(key, convert.ToString(strategy)); err != nil {
+			return nil, err
+		}
+		result[canonicalKey(strings.Split(key, "."))] = convert.ToString(strategy)
+	}
+	return result, nil
+}
+
+// checkMergeStrategy verifies that strategy can be used for key, returning the internal names of the key.
+func checkMergeStrategy(key, strategy string) ([]string, mapper.Field, error) {
+	names, field, ok := resolveKey(strings.Split(key, "."))
+	if !ok {
+		return nil, field, fmt.Errorf("%s: unknown key %q", mergeStrategyKey, key)
+	}
+
+	switch {
+	case definition.IsArrayType(field.Type):
+		if strategy == mergeReplace || strategy == mergeAppend || strategy == mergePrepend {
+			return names, field, nil
+		}
+		return nil, field, fmt.Errorf("%s: invalid strategy %q for list %q, expected replace, append or prepend", mergeStrategyKey, strategy, key)
+	case field.Type == "map[string]":
+		if strategy == mergeReplace || strategy == mergeMaps {
+			return names, field, nil
+		}
+		return nil, field, fmt.Errorf("%s: invalid strategy %q for map %q, expected replace or merge", mergeStrategyKey, strategy, key)
+	}
+	return nil, field, fmt.Errorf("%s: %q is not a list or a map", mergeStrategyKey, key)
+}
+
+// applyMergeStrategies combines the values in src with the values already in dest, according to strategies,
+// storing the result in src so that it replaces the value in dest when merged.
+func applyMergeStrategies(strategies map[string]string, dest, src map[string]interface{}) error {
+	for key, strategy := range strategies {
+		names, _, err := checkMergeStrategy(key, strategy)
+		if err != nil {
+			return err
+		}
+
+		newValue, ok := values.GetValue(src, names...)
+		if !ok || strategy == mergeReplace {
+			continue
+		}
+		oldValue, _ := values.GetValue(dest, names...)
+
+		switch strategy {
+		case mergeAppend:
+			values.PutValue(src, append(toList(oldValue), toList(newValue)...), names...)
+		case mergePrepend:
+			values.PutValue(src, append(toList(newValue), toList(oldValue)...), names...)
+		case mergeMaps:
+			merged := toMap(oldValue)
+			for k, v := range toMap(newValue) {
+				merged[k] = v
+			}
+			values.PutValue(src, merged, names...)
+		}
+	}
+	return nil
+}
+
+// resolveKey maps a path of possibly fuzzy key names to the internal names of the field it refers to.
+func resolveKey(keys []string) ([]string, mapper.Field, bool) {
+	var (
+		names []string
+		field mapper.Field
+	)
+
+	s := schema
+	for i, k := range keys {
+		if s == nil {
+			return nil, field, false
+		}
+		name, ok := fieldName(s, k)
+		if !ok {
+			return nil, field, false
+		}
+		names = append(names, name)
+		field = s.ResourceFields[name]
+		if i < len(keys)-1 {
+			s = schemas.Schema(field.Type)
+		}
+	}
+	return names, field, len(names) > 0
+}
+
+func toList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return append([]interface{}{}, v...)
+	case []string:
+		result := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			result = append(result, s)
+		}
+		return result
+	case nil:
+		return nil
+	}
+	return []interface{}{value}
+}
+
+func toMap(value interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			result[k] = val
+		}
+	case map[string]string:
+		for k, val := range v {
+			result[k] = val
+		}
+	}
+	return result
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var moduleName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ShouldLoad reports whether the module is loaded, rather than only configured.
+func (m *Module) ShouldLoad() bool {
+	if m.Load != nil {
+		return *m.Load
+	}
+	return !m.Blacklist
+}
+
+// Validate checks that the module can be written to modprobe.d.
+func (m *Module) Validate() error {
+	if !moduleName.MatchString(m.Name) {
+		return fmt.Errorf("invalid name %q", m.Name)
+	}
+	if m.Blacklist && m.Load != nil && *m.Load {
+		return fmt.Errorf("a blacklisted module cannot be loaded")
+	}
+	if strings.Contains(m.Options, "\n") || strings.Contains(m.Softdep, "\n") {
+		return fmt.Errorf("options and softdep must be on one line")
+	}
+	if m.Softdep != "" && !validSoftdep(strings.Fields(m.Softdep)) {
+		return fmt.Errorf("invalid softdep %q, expected e.g. \"pre: crc32c\"", m.Softdep)
+	}
+	return nil
+}
+
+// validSoftdep checks that the fields start with pre: or post:, and that each is followed by modules.
+func validSoftdep(fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	modules := 0
+	for i, field := range fields {
+		switch {
+		case field == "pre:" || field == "post:":
+			if i > 0 && modules == 0 {
+				return false
+			}
+			modules = 0
+		case i == 0 || !moduleName.MatchString(field):
+			return false
+		default:
+			modules++
+		}
+	}
+	return modules > 0
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestModuleValidate(t *testing.T) {
+	load := true
+	tests := []struct {
+		module Module
+		err    string
+	}{
+		{Module{Name: "zfs"}, ""},
+		{Module{Name: "btrfs", Softdep: "pre: crc32c"}, ""},
+		{Module{Name: "nvme", Softdep: "pre: crc32c crct10dif post: nvme_core"}, ""},
+		{Module{Name: "nouveau", Blacklist: true}, ""},
+		{Module{Name: "zfs spl"}, "invalid name"},
+		{Module{Name: "nouveau", Blacklist: true, Load: &load}, "cannot be loaded"},
+		{Module{Name: "btrfs", Options: "a=1\nb=2"}, "on one line"},
+		{Module{Name: "btrfs", Softdep: "   "}, "invalid softdep"},
+		{Module{Name: "btrfs", Softdep: "crc32c"}, "invalid softdep"},
+		{Module{Name: "btrfs", Softdep: "pre:"}, "invalid softdep"},
+		{Module{Name: "btrfs", Softdep: "pre: post: crc32c"}, "invalid softdep"},
+		{Module{Name: "btrfs", Softdep: "pre: crc32c post:"}, "invalid softdep"},
+		{Module{Name: "btrfs", Softdep: "pre: crc32c;reboot"}, "invalid softdep"},
+	}
+	for _, test := range tests {
+		err := test.module.Validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: got %v, expected %q", test.module, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+)
+
+// Origin is a value set for a config key by one of the config sources.
+type Origin struct {
+	// Source is the name of the reader, e.g. system, cmdline, local, config.d
+	Source string `json:"source"`
+	// Path is the file, or the kernel cmdline token, that the value was read from
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value"`
+	// Strategy is how the value was merged with the values before it, if it did not replace them
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// Provenance maps each config key to the values set for it by each source, in the order they were merged.
+// The last origin of a key is the effective one.
+type Provenance map[string][]Origin
+
+func (p Provenance) record(s source, strategies map[string]string, sch *mapper.Schema, prefix string, data map[string]interface{}) {
+	for name, field := range sch.ResourceFields {
+		value, ok := data[name]
+		if !ok || value == nil {
+			continue
+		}
+
+		key := prefix + convert.ToYAMLKey(name)
+		if sub := schemas.Schema(field.Type); sub != nil && !definition.IsArrayType(field.Type) {
+			if m, ok := value.(map[string]interface{}); ok {
+				p.record(s, strategies, sub, key+".", m)
+				continue
+			}
+		}
+
+		path := s.path
+		if s.describe != nil {
+			if detail := s.describe(key); detail != "" {
+				path = detail
+			}
+		}
+		strategy := strategies[key]
+		if strategy == mergeReplace {
+			strategy = ""
+		}
+		p[key] = append(p[key], Origin{
+			Source:   s.name,
+			Path:     path,
+			Value:    value,
+			Strategy: strategy,
+		})
+	}
+}
+
+// WriteProvenance prints every effective key along with the source that set it and the values it overrode.
+func WriteProvenance(p Provenance, writer io.Writer) error {
+	var keys []string
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		origins := p[key]
+		last := origins[len(origins)-1]
+		if _, err := fmt.Fprintf(writer, "%s: %s\n  set by %s\n", key, toJSON(last.Value), describeOrigin(last)); err != nil {
+			return err
+		}
+		verb := "overrides"
+		for i := len(origins) - 2; i >= 0; i-- {
+			if origins[i+1].Strategy != "" {
+				verb = "merged with"
+			}
+			if _, err := fmt.Fprintf(writer, "  %s %s from %s\n", verb, toJSON(origins[i].Value), describeOrigin(origins[i])); err != nil {
+				return err
+			}
+			verb = "overrides"
+		}
+	}
+	return nil
+}
+
+func describeOrigin(o Origin) string {
+	result := o.Source
+	if o.Path != "" {
+		result = fmt.Sprintf("%s (%s)", o.Source, o.Path)
+	}
+	if o.Strategy != "" {
+		result = fmt.Sprintf("%s [%s]", result, o.Strategy)
+	}
+	return result
+}
+
+func toJSON(value interface{}) string {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(bytes)
+}
+
+// canonicalKey maps a path of possibly fuzzy key names to the key used in Provenance.
+func canonicalKey(keys []string) string {
+	var result []string
+	s := schema
+	for i, k := range keys {
+		name, ok := fieldName(s, k)
+		if !ok {
+			return strings.Join(append(result, keys[i:]...), ".")
+		}
+		result = append(result, convert.ToYAMLKey(name))
+		fieldType := s.ResourceFields[name].Type
+		if s = schemas.Schema(fieldType); s == nil || definition.IsArrayType(fieldType) {
+			break
+		}
+	}
+	return strings.Join(result, ".")
+}
+
+// cmdlineToken returns the kernel cmdline tokens that set key.
+func cmdlineToken(key string) string {
+	bytes, err := ioutil.ReadFile(cmdline)
+	if err != nil {
+		return ""
+	}
+
+	var tokens []string
+	params, _ := parseCmdline(string(bytes))
+	for _, p := range params {
+		if canonicalKey(p.keys) == key {
+			tokens = append(tokens, p.token)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
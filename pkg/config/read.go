@@ -5,7 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/ghodss/yaml"
@@ -13,7 +13,6 @@ import (
 	"github.com/rancher/mapper"
 	"github.com/rancher/mapper/convert"
 	merge2 "github.com/rancher/mapper/convert/merge"
-	"github.com/rancher/mapper/values"
 )
 
 var (
@@ -22,6 +21,7 @@ var (
 	// LocalConfig is the local system configuration
 	LocalConfig  = system.LocalPath("config.yaml")
 	localConfigs = system.LocalPath("config.d")
+	cmdline      = "/proc/cmdline"
 )
 
 var (
@@ -31,18 +31,19 @@ var (
 				NewToMap(),
 				NewToSlice(),
 				NewToBool(),
+				NewToModules(),
 				&FuzzyNames{},
 			}
 		}
 		return s
 	}).MustImport(CloudConfig{})
 	schema  = schemas.Schema("cloudConfig")
-	readers = []reader{
-		readSystemConfig,
-		readCmdline,
-		readLocalConfig,
-		readCloudConfig,
-		readUserData,
+	sources = []source{
+		{name: "system", path: SystemConfig, read: readSystemConfig},
+		{name: "cmdline", path: cmdline, read: readCmdline, describe: cmdlineToken},
+		{name: "local", path: LocalConfig, read: readLocalConfig},
+		{name: "cloud-config", path: "/run/config", read: readCloudConfig},
+		{name: "userdata", path: userdata, read: readUserData},
 	}
 )
 
@@ -69,37 +70,125 @@ func mapToEnv(prefix string, data map[string]interface{}) []string {
 	return result
 }
 
+// secretMode is how encrypted values are handled when the config is read.
+type secretMode int
+
+const (
+	// secretsDecrypt decrypts secrets, failing if the node has no secret key
+	secretsDecrypt secretMode = iota
+	// secretsDecryptIfKey decrypts secrets, leaving them empty if the node has no secret key
+	secretsDecryptIfKey
+	// secretsKeep leaves secrets encrypted
+	secretsKeep
+)
+
+// ReadConfig reads the config, decrypting its secrets. It fails if there are secrets and the node has no
+// secret key.
 func ReadConfig() (CloudConfig, error) {
-	return readersToObject(append(readers, readLocalConfigs()...)...)
+	return sourcesToObject(nil, secretsDecrypt, append(sources, readLocalConfigs()...)...)
+}
+
+// ReadInitrdConfig reads the config in the same way as ReadConfig, except that secrets are left empty if
+// the node has no secret key, as in the initrd, before the local state is available.
+func ReadInitrdConfig() (CloudConfig, error) {
+	return sourcesToObject(nil, secretsDecryptIfKey, append(sources, readLocalConfigs()...)...)
+}
+
+// ReadEncryptedConfig reads the config in the same way as ReadConfig, except that secrets are left
+// encrypted, so that the config can be written out without them.
+func ReadEncryptedConfig() (CloudConfig, error) {
+	return sourcesToObject(nil, secretsKeep, append(sources, readLocalConfigs()...)...)
+}
+
+// ReadRawConfig reads the config without expanding its templates or decrypting its secrets, for early
+// in the boot, before the network facts of the templates or the secret key are available.
+func ReadRawConfig() (CloudConfig, error) {
+	result := CloudConfig{
+		K3OS: K3OS{
+			Install: &Install{},
+		},
+	}
+	data, err := merge(nil, append(sources, readLocalConfigs()...)...)
+	if err != nil {
+		return result, err
+	}
+	return result, convert.ToObj(data, &result)
+}
+
+// ReadConfigWithProvenance reads the config in the same way as ReadConfig, and also returns which
+// source set each key.
+func ReadConfigWithProvenance() (CloudConfig, Provenance, error) {
+	p := Provenance{}
+	cfg, err := sourcesToObject(p, secretsDecrypt, append(sources, readLocalConfigs()...)...)
+	return cfg, p, err
 }
 
 func readersToObject(readers ...reader) (CloudConfig, error) {
+	var s []source
+	for _, r := range readers {
+		s = append(s, source{read: r})
+	}
+	return sourcesToObject(nil, secretsDecrypt, s...)
+}
+
+func sourcesToObject(p Provenance, secrets secretMode, sources ...source) (CloudConfig, error) {
 	result := CloudConfig{
 		K3OS: K3OS{
 			Install: &Install{},
 		},
 	}
 
-	data, err := merge(readers...)
+	data, err := merge(p, sources...)
 	if err != nil {
 		return result, err
 	}
 
+	data, err = expandTemplates(data)
+	if err != nil {
+		return result, err
+	}
+
+	if secrets != secretsKeep {
+		data, err = decryptSecrets(data, secrets == secretsDecryptIfKey)
+		if err != nil {
+			return result, err
+		}
+	}
+
 	return result, convert.ToObj(data, &result)
 }
 
 type reader func() (map[string]interface{}, error)
 
-func merge(readers ...reader) (map[string]interface{}, error) {
+// source is a reader along with where it reads from
+type source struct {
+	name string
+	path string
+	read reader
+	// describe, if set, returns where a single key was read from
+	describe func(key string) string
+}
+
+func merge(p Provenance, sources ...source) (map[string]interface{}, error) {
 	data := map[string]interface{}{}
-	for _, r := range readers {
-		newData, err := r()
+	for _, s := range sources {
+		newData, err := s.read()
 		if err != nil {
 			return nil, err
 		}
+		strategies, err := popMergeStrategies(newData)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.path, err)
+		}
 		if err := schema.Mapper.ToInternal(newData); err != nil {
 			return nil, err
 		}
+		if err := applyMergeStrategies(strategies, data, newData); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.path, err)
+		}
+		if p != nil {
+			p.record(s, strategies, schema, "", newData)
+		}
 		data = merge2.UpdateMerge(schema, schemas, data, newData, false)
 	}
 	return data, nil
@@ -113,54 +202,88 @@ func readLocalConfig() (map[string]interface{}, error) {
 	return readFile(LocalConfig)
 }
 
-func readLocalConfigs() []reader {
-	var result []reader
+func readLocalConfigs() []source {
+	var result []source
 
-	files, err := ioutil.ReadDir(localConfigs)
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return []reader{
-			func() (map[string]interface{}, error) {
+	paths, err := localConfigPaths()
+	if err != nil {
+		return []source{{
+			name: "config.d",
+			path: localConfigs,
+			read: func() (map[string]interface{}, error) {
 				return nil, err
 			},
-		}
+		}}
 	}
 
-	for _, f := range files {
-		p := filepath.Join(localConfigs, f.Name())
-		result = append(result, func() (map[string]interface{}, error) {
-			return readFile(p)
+	for _, p := range paths {
+		p := p
+		result = append(result, source{
+			name: "config.d",
+			path: p,
+			read: func() (map[string]interface{}, error) {
+				return readFile(p)
+			},
 		})
 	}
 
 	return result
 }
 
-func readFile(path string) (map[string]interface{}, error) {
-	f, err := ioutil.ReadFile(path)
+func localConfigPaths() ([]string, error) {
+	var result []string
+
+	files, err := ioutil.ReadDir(localConfigs)
 	if os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	data := map[string]interface{}{}
-	if err := yaml.Unmarshal(f, &data); err != nil {
-		return nil, err
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		result = append(result, filepath.Join(localConfigs, f.Name()))
 	}
+	// config.d files are always merged in lexical order of their names
+	sort.Strings(result)
 
-	return data, nil
+	return result, nil
 }
 
-func readCmdline() (map[string]interface{}, error) {
-	//supporting regex https://regexr.com/4mq0s
-	parser, err := regexp.Compile(`(\"[^\"]+\")|([^\s]+=(\"[^\"]+\")|([^\s]+))`)
-	if err != nil {
-		return nil, nil
+// Paths returns the config files on disk that are read by ReadConfig, in the order that they are merged.
+func Paths() ([]string, error) {
+	var result []string
+	for _, p := range []string{SystemConfig, LocalConfig} {
+		if _, err := os.Stat(p); err == nil {
+			result = append(result, p)
+		}
 	}
 
-	bytes, err := ioutil.ReadFile("/proc/cmdline")
+	paths, err := localConfigPaths()
+	return append(result, paths...), err
+}
+
+// WatchPaths returns the directories holding the config files that can change while the system is running:
+// the local config, config.d and the cloud metadata and userdata.
+func WatchPaths() []string {
+	return []string{filepath.Dir(LocalConfig), localConfigs, filepath.Dir(userdata)}
+}
+
+// IsConfigPath reports whether path, in one of WatchPaths, is read as config.
+func IsConfigPath(path string) bool {
+	switch filepath.Dir(path) {
+	case filepath.Dir(LocalConfig):
+		return path == LocalConfig || path == localConfigs
+	case localConfigs, filepath.Dir(userdata):
+		return true
+	}
+	return false
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	f, err := ioutil.ReadFile(path)
 	if os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
@@ -168,24 +291,8 @@ func readCmdline() (map[string]interface{}, error) {
 	}
 
 	data := map[string]interface{}{}
-	for _, item := range parser.FindAllString(string(bytes), -1) {
-		parts := strings.SplitN(item, "=", 2)
-		value := "true"
-		if len(parts) > 1 {
-			value = strings.Trim(parts[1], `"`)
-		}
-		keys := strings.Split(strings.Trim(parts[0], `"`), ".")
-		existing, ok := values.GetValue(data, keys...)
-		if ok {
-			switch v := existing.(type) {
-			case string:
-				values.PutValue(data, []string{v, value}, keys...)
-			case []string:
-				values.PutValue(data, append(v, value), keys...)
-			}
-		} else {
-			values.PutValue(data, value, keys...)
-		}
+	if err := yaml.Unmarshal(f, &data); err != nil {
+		return nil, err
 	}
 
 	return data, nil
@@ -1,6 +1,13 @@
 package config
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestDataSource(t *testing.T) {
 	cc, err := readersToObject(func() (map[string]interface{}, error) {
@@ -47,3 +54,218 @@ func TestAuthorizedKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestModules(t *testing.T) {
+	cc, err := readersToObject(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"k3os": map[string]interface{}{
+				"modules": []interface{}{
+					"kvm",
+					"nvme_core multipath=0 io_timeout=60",
+					map[string]interface{}{"name": "nouveau", "blacklist": true},
+				},
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Module{
+		{Name: "kvm"},
+		{Name: "nvme_core", Options: "multipath=0 io_timeout=60"},
+		{Name: "nouveau", Blacklist: true},
+	}
+	if !reflect.DeepEqual(cc.K3OS.Modules, expected) {
+		t.Fatalf("got %+v, expected %+v", cc.K3OS.Modules, expected)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	p := Provenance{}
+	_, err := sourcesToObject(p, secretsDecrypt,
+		source{
+			name: "system",
+			path: "/k3os/system/config.yaml",
+			read: func() (map[string]interface{}, error) {
+				return map[string]interface{}{
+					"k3os": map[string]interface{}{
+						"token":          "one",
+						"dns_nameserver": "8.8.8.8",
+					},
+				}, nil
+			},
+		},
+		source{
+			name: "local",
+			path: "/var/lib/rancher/k3os/config.yaml",
+			read: func() (map[string]interface{}, error) {
+				return map[string]interface{}{
+					"k3os": map[string]interface{}{
+						"token": "two",
+					},
+				}, nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origins := p["k3os.token"]
+	if len(origins) != 2 {
+		t.Fatalf("got %d origins for k3os.token, expected 2", len(origins))
+	}
+	if origins[1].Source != "local" || origins[1].Value != "two" {
+		t.Fatalf("k3os.token set by %s to %v, expected local to set two", origins[1].Source, origins[1].Value)
+	}
+	if origins := p["k3os.dns_nameservers"]; len(origins) != 1 || origins[0].Source != "system" {
+		t.Fatalf("k3os.dns_nameservers origins %v, expected system", origins)
+	}
+}
+
+func TestMergeStrategies(t *testing.T) {
+	c1 := map[string]interface{}{
+		"ssh_authorized_keys": []string{
+			"one...",
+		},
+		"k3os": map[string]interface{}{
+			"sysctls": map[string]interface{}{
+				"kernel.printk": "4 4 1 7",
+			},
+		},
+	}
+	c2 := map[string]interface{}{
+		"merge_strategy": map[string]interface{}{
+			"ssh_authorized_keys": "append",
+			"k3os.sysctl":         "merge",
+		},
+		"ssh_authorized_keys": []string{
+			"two...",
+		},
+		"k3os": map[string]interface{}{
+			"sysctls": map[string]interface{}{
+				"kernel.kptr_restrict": "1",
+			},
+		},
+	}
+	cc, err := readersToObject(
+		func() (map[string]interface{}, error) {
+			return c1, nil
+		},
+		func() (map[string]interface{}, error) {
+			return c2, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.SSHAuthorizedKeys) != 2 || cc.SSHAuthorizedKeys[0] != "one..." {
+		t.Fatalf("got keys %v, expected [one... two...]", cc.SSHAuthorizedKeys)
+	}
+	if len(cc.K3OS.Sysctls) != 2 {
+		t.Fatalf("got sysctls %v, expected both to be merged", cc.K3OS.Sysctls)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	os.Setenv("K3OS_TEST_REGION", "us-west-1")
+	defer os.Unsetenv("K3OS_TEST_REGION")
+
+	cc, err := readersToObject(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"k3os": map[string]interface{}{
+				"labels": map[string]interface{}{
+					"region": `{{ .Env "K3OS_TEST_REGION" }}`,
+				},
+			},
+			"write_files": []interface{}{
+				map[string]interface{}{
+					"path":    "/etc/motd",
+					"content": "{{ .Verbatim }}",
+				},
+			},
+			"run_cmd": []interface{}{
+				"docker ps --format '{{.Names}}'",
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.K3OS.Labels["region"] != "us-west-1" {
+		t.Fatalf("region label %q, expected us-west-1", cc.K3OS.Labels["region"])
+	}
+	if cc.WriteFiles[0].Content != "{{ .Verbatim }}" {
+		t.Fatalf("file content %q was expanded", cc.WriteFiles[0].Content)
+	}
+	if len(cc.Runcmd) != 1 || cc.Runcmd[0] != "docker ps --format '{{.Names}}'" {
+		t.Fatalf("run_cmd %q was expanded", cc.Runcmd)
+	}
+
+	_, err = readersToObject(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"hostname": "{{ .MAC.doesnotexist0 }}",
+		}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "hostname") || !strings.Contains(err.Error(), "doesnotexist0") {
+		t.Fatalf("expected an error naming the key and the missing fact, got %v", err)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k3os-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(key, sealed string) {
+		SecretKey, SealedSecretKey = key, sealed
+	}(SecretKey, SealedSecretKey)
+	SecretKey = filepath.Join(dir, "secret.key")
+	SealedSecretKey = filepath.Join(dir, "secret.key.ctx")
+
+	token, err := Encrypt("K10secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, SecretPrefix) || strings.Contains(token, "K10secret") {
+		t.Fatalf("got envelope %q", token)
+	}
+
+	cc, err := readersToObject(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"k3os": map[string]interface{}{
+				"token": token,
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.K3OS.Token != "K10secret" {
+		t.Fatalf("got token %q, expected it to be decrypted", cc.K3OS.Token)
+	}
+	if redacted := Redact(cc); redacted.K3OS.Token == "K10secret" || cc.K3OS.Token != "K10secret" {
+		t.Fatalf("got token %q after redaction", redacted.K3OS.Token)
+	}
+
+	withToken := source{read: func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"k3os": map[string]interface{}{
+				"token": token,
+			},
+		}, nil
+	}}
+	if cc, err := sourcesToObject(nil, secretsKeep, withToken); err != nil || cc.K3OS.Token != token {
+		t.Fatalf("got token %q, %v, expected it to stay encrypted", cc.K3OS.Token, err)
+	}
+
+	os.Remove(SecretKey)
+	if _, err := sourcesToObject(nil, secretsDecrypt, withToken); err == nil || !strings.Contains(err.Error(), "k3os.token") {
+		t.Fatalf("got %v, expected an error for the token without a secret key", err)
+	}
+	if cc, err := sourcesToObject(nil, secretsDecryptIfKey, withToken); err != nil || cc.K3OS.Token != "" {
+		t.Fatalf("got token %q, %v, expected it to be left empty without a secret key", cc.K3OS.Token, err)
+	}
+}
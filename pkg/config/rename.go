@@ -22,27 +22,44 @@ func (f *FuzzyNames) ToInternal(data map[string]interface{}) error {
 	return nil
 }
 
-func (f *FuzzyNames) addName(name, toName string) {
-	f.names[strings.ToLower(name)] = toName
-	f.names[convert.ToYAMLKey(name)] = toName
-	f.names[strings.ToLower(convert.ToYAMLKey(name))] = toName
+func (f *FuzzyNames) ModifySchema(schema *mapper.Schema, schemas *mapper.Schemas) error {
+	f.names = fuzzyNames(schema)
+	return nil
 }
 
-func (f *FuzzyNames) ModifySchema(schema *mapper.Schema, schemas *mapper.Schemas) error {
-	f.names = map[string]string{}
+func fuzzyNames(schema *mapper.Schema) map[string]string {
+	names := map[string]string{}
+	addName := func(name, toName string) {
+		names[strings.ToLower(name)] = toName
+		names[convert.ToYAMLKey(name)] = toName
+		names[strings.ToLower(convert.ToYAMLKey(name))] = toName
+	}
 
 	for name := range schema.ResourceFields {
 		if strings.HasSuffix(name, "s") && len(name) > 1 {
-			f.addName(name[:len(name)-1], name)
+			addName(name[:len(name)-1], name)
 		}
 		if strings.HasSuffix(name, "es") && len(name) > 2 {
-			f.addName(name[:len(name)-2], name)
+			addName(name[:len(name)-2], name)
 		}
-		f.addName(name, name)
+		addName(name, name)
 	}
 
-	f.names["pass"] = "passphrase"
-	f.names["password"] = "passphrase"
+	names["pass"] = "passphrase"
+	names["password"] = "passphrase"
 
-	return nil
+	return names
+}
+
+// fieldName resolves key, as it may be spelled in a config file, to the name of the schema field it populates.
+func fieldName(schema *mapper.Schema, key string) (string, bool) {
+	if _, ok := schema.ResourceFields[key]; ok {
+		return key, true
+	}
+	if name, ok := fuzzyNames(schema)[key]; ok {
+		if _, ok := schema.ResourceFields[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
 }
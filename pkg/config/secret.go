@@ -0,0 +1,240 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rancher/k3os/pkg/system"
+	"github.com/sirupsen/logrus"
+)
+
+// SecretPrefix marks a config value as a secret encrypted with the node's secret key, e.g. `enc:v1:...`
+const SecretPrefix = "enc:v1:"
+
+// redacted replaces secrets when the config is printed
+const redacted = "<redacted>"
+
+var errNoSecretKey = errors.New("no secret key")
+
+var (
+	// SecretKey is the file holding the node's secret key, base64 encoded
+	SecretKey = system.LocalPath("secret.key")
+	// SealedSecretKey is a TPM object context holding the node's sealed secret key; when it can be
+	// unsealed with tpm2_unseal it is used instead of SecretKey
+	SealedSecretKey = system.LocalPath("secret.key.ctx")
+)
+
+// Encrypt seals plaintext with the node's secret key, generating the key if there is none yet.
+func Encrypt(plaintext string) (string, error) {
+	key, err := readSecretKey()
+	if os.IsNotExist(err) {
+		key, err = generateSecretKey()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return SecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt.
+func Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, SecretPrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, SecretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %v", err)
+	}
+	key, err := readSecretKey()
+	if os.IsNotExist(err) {
+		return "", errNoSecretKey
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read secret key: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("invalid secret: too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// decryptSecrets replaces every encrypted value in data with its plaintext. If the node has no secret
+// key, the secrets are left empty when ifKey is set, e.g. in the initrd before the local state is
+// available, and are an error otherwise.
+func decryptSecrets(data map[string]interface{}, ifKey bool) (map[string]interface{}, error) {
+	return mapStrings(data, func(key, value string) (string, error) {
+		plaintext, err := Decrypt(value)
+		if err == errNoSecretKey && ifKey {
+			logrus.Warnf("unable to decrypt %s: %s does not exist", key, SecretKey)
+			return "", nil
+		} else if err == errNoSecretKey {
+			return "", fmt.Errorf("unable to decrypt %s: %s does not exist", key, SecretKey)
+		} else if err != nil {
+			return "", fmt.Errorf("%s: %v", key, err)
+		}
+		return plaintext, nil
+	})
+}
+
+// Redact returns a copy of cfg with its secrets replaced, for printing.
+func Redact(cfg CloudConfig) CloudConfig {
+	cfg.K3OS.Token = redact(cfg.K3OS.Token)
+	cfg.K3OS.Password = redact(cfg.K3OS.Password)
+	if len(cfg.K3OS.Wifi) > 0 {
+		wifi := make([]Wifi, len(cfg.K3OS.Wifi))
+		for i, w := range cfg.K3OS.Wifi {
+			w.Passphrase = redact(w.Passphrase)
+			w.PrivateKeyPassphrase = redact(w.PrivateKeyPassphrase)
+			wifi[i] = w
+		}
+		cfg.K3OS.Wifi = wifi
+	}
+	if len(cfg.Users) > 0 {
+		users := make([]User, len(cfg.Users))
+		for i, u := range cfg.Users {
+			u.Password = redact(u.Password)
+			users[i] = u
+		}
+		cfg.Users = users
+	}
+	if cfg.K3OS.SSH != nil && len(cfg.K3OS.SSH.HostKeys) > 0 {
+		ssh := *cfg.K3OS.SSH
+		ssh.HostKeys = make([]SSHHostKey, len(cfg.K3OS.SSH.HostKeys))
+		for i, k := range cfg.K3OS.SSH.HostKeys {
+			k.Key = redact(k.Key)
+			ssh.HostKeys[i] = k
+		}
+		cfg.K3OS.SSH = &ssh
+	}
+	if cfg.K3OS.HTTP != nil {
+		http := *cfg.K3OS.HTTP
+		http.HTTPProxy = redactURL(http.HTTPProxy)
+		http.HTTPSProxy = redactURL(http.HTTPSProxy)
+		cfg.K3OS.HTTP = &http
+	}
+	return cfg
+}
+
+// Redact replaces the secrets in the recorded values, for printing.
+func (p Provenance) Redact() {
+	for _, key := range []string{"k3os.token", "k3os.password"} {
+		for i := range p[key] {
+			p[key][i].Value = redacted
+		}
+	}
+	p.redactEntries("k3os.wifi", "wifi", "passphrase", "privateKeyPassphrase")
+	p.redactEntries("users", "user", "password")
+	p.redactEntries("k3os.ssh.host_keys", "sshHostKey", "key")
+	for _, key := range []string{"k3os.http.http_proxy", "k3os.http.https_proxy"} {
+		for i, v := range p[key] {
+			if s, ok := v.Value.(string); ok {
+				p[key][i].Value = redactURL(s)
+			}
+		}
+	}
+}
+
+// redactEntries replaces the fields of the entries of the list at key, however they are spelled.
+func (p Provenance) redactEntries(key, schemaID string, fields ...string) {
+	for i, o := range p[key] {
+		var entries []interface{}
+		for _, e := range toList(o.Value) {
+			e := toMap(e)
+			for k := range e {
+				name, _ := fieldName(schemas.Schema(schemaID), k)
+				for _, f := range fields {
+					if name == f {
+						e[k] = redacted
+					}
+				}
+			}
+			entries = append(entries, e)
+		}
+		p[key][i].Value = entries
+	}
+}
+
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL replaces the password of a URL, such as that of a proxy.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+	return u.Redacted()
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func readSecretKey() ([]byte, error) {
+	encoded, err := ioutil.ReadFile(SecretKey)
+	if _, statErr := os.Stat(SealedSecretKey); statErr == nil {
+		unsealed, tpmErr := exec.Command("tpm2_unseal", "-c", SealedSecretKey).Output()
+		if tpmErr == nil {
+			encoded, err = unsealed, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to unseal %s: %v", SealedSecretKey, tpmErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+}
+
+func generateSecretKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(system.LocalPath(), 0755); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := ioutil.WriteFile(SecretKey, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
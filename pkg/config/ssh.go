@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SSHHostKeyTypes are the host key types that sshd generates, and that can be replaced in k3os.ssh.host_keys.
+var SSHHostKeyTypes = []string{"rsa", "ecdsa", "ed25519"}
+
+// Validate checks the settings, and that sshd can use the CA keys, host keys and certificates. The
+// algorithm names are left for sshd -t to check.
+func (s *SSH) Validate() error {
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port %d", s.Port)
+	}
+	switch s.PermitRootLogin {
+	case "", "yes", "no", "prohibit-password", "forced-commands-only":
+	default:
+		return fmt.Errorf("invalid permit_root_login %q, expected yes, no, prohibit-password or forced-commands-only", s.PermitRootLogin)
+	}
+	for _, list := range []struct {
+		key    string
+		values []string
+	}{
+		{"listen_addresses", s.ListenAddresses},
+		{"ciphers", s.Ciphers},
+		{"macs", s.MACs},
+		{"kex_algorithms", s.KexAlgorithms},
+		{"allow_users", s.AllowUsers},
+	} {
+		for _, value := range list.values {
+			if value == "" || strings.ContainsAny(value, " \t\n,#") {
+				return fmt.Errorf("invalid %s entry %q", list.key, value)
+			}
+		}
+	}
+
+	for _, key := range s.TrustedUserCAKeys {
+		if len(strings.Fields(key)) < 2 {
+			return fmt.Errorf("invalid trusted_user_ca_keys entry %q, expected a public key", key)
+		}
+	}
+
+	types := map[string]bool{}
+	for i, k := range s.HostKeys {
+		if err := k.Validate(); err != nil {
+			return fmt.Errorf("host_keys[%d]: %v", i, err)
+		}
+		if types[k.Type] {
+			return fmt.Errorf("host_keys[%d]: duplicate type %s", i, k.Type)
+		}
+		types[k.Type] = true
+	}
+	return nil
+}
+
+// Validate checks that the host key has a known type and either a private key or a certificate.
+func (k *SSHHostKey) Validate() error {
+	valid := false
+	for _, t := range SSHHostKeyTypes {
+		valid = valid || k.Type == t
+	}
+	if !valid {
+		return fmt.Errorf("invalid type %q, expected %s", k.Type, strings.Join(SSHHostKeyTypes, ", "))
+	}
+	if k.Key == "" && k.Certificate == "" {
+		return fmt.Errorf("missing key or certificate")
+	}
+	if k.Key != "" && !strings.Contains(k.Key, "PRIVATE KEY-----") {
+		return fmt.Errorf("key must be a private key in PEM or OpenSSH format")
+	}
+	if fields := strings.Fields(k.Certificate); k.Certificate != "" && (len(fields) < 2 || !strings.HasSuffix(fields[0], "-cert-v01@openssh.com")) {
+		return fmt.Errorf("certificate must be an OpenSSH certificate, as written by ssh-keygen -s")
+	}
+	return nil
+}
+
+// ValidatePrincipals checks that each principal can be written to an AuthorizedPrincipalsFile.
+func ValidatePrincipals(principals []string) error {
+	for _, p := range principals {
+		if p == "" || strings.ContainsAny(p, " \t\n#") {
+			return fmt.Errorf("invalid principal %q", p)
+		}
+	}
+	return nil
+}
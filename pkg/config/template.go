@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/rancher/mapper/convert"
+)
+
+const (
+	netClassDir = "/sys/class/net"
+	dmiDir      = "/sys/class/dmi/id"
+)
+
+// facts are the only values that templates in config values can refer to, e.g.
+// `{{ .MAC.eth0 }}`, `{{ .DMI.product_serial }}`, `{{ .Cmdline "foo" }}` or `{{ .Env "X" }}`.
+type facts struct {
+	// MAC is the hardware address of each network interface, by name
+	MAC map[string]string
+	// DMI is each readable entry of /sys/class/dmi/id, by name
+	DMI map[string]string
+
+	cmdline map[string]string
+}
+
+func newFacts() *facts {
+	f := &facts{
+		MAC:     map[string]string{},
+		DMI:     map[string]string{},
+		cmdline: map[string]string{},
+	}
+
+	links, _ := ioutil.ReadDir(netClassDir)
+	for _, link := range links {
+		if mac := readTrimmed(filepath.Join(netClassDir, link.Name(), "address")); mac != "" {
+			f.MAC[link.Name()] = mac
+		}
+	}
+
+	entries, _ := ioutil.ReadDir(dmiDir)
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			if value := readTrimmed(filepath.Join(dmiDir, entry.Name())); value != "" {
+				f.DMI[entry.Name()] = value
+			}
+		}
+	}
+
+	if bytes, err := ioutil.ReadFile(cmdline); err == nil {
+		params, _ := parseCmdline(string(bytes))
+		for _, p := range params {
+			f.cmdline[strings.Join(p.keys, ".")] = p.cmdlineValue()
+		}
+	}
+
+	return f
+}
+
+// Cmdline returns the value of a kernel cmdline parameter.
+func (f *facts) Cmdline(key string) (string, error) {
+	if value, ok := f.cmdline[key]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("kernel cmdline parameter %q is not set", key)
+}
+
+// Env returns the value of an environment variable.
+func (f *facts) Env(key string) (string, error) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("environment variable %q is not set", key)
+}
+
+// expander renders the templates found in the string values of the merged config.
+type expander struct {
+	facts *facts
+}
+
+// verbatim reports whether the value at key is used as it is. File content may well be a template for
+// something else, and commands often pass templates on, e.g. `kubectl -o go-template=...`.
+func verbatim(key string) bool {
+	if strings.HasPrefix(key, "write_files[") && strings.HasSuffix(key, "].content") {
+		return true
+	}
+	for _, cmd := range []string{"run_cmd[", "boot_cmd[", "init_cmd["} {
+		if strings.HasPrefix(key, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *expander) render(key, value string) (string, error) {
+	if verbatim(key) {
+		return value, nil
+	}
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	if e.facts == nil {
+		e.facts = newFacts()
+	}
+
+	t, err := template.New(key).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template in %s: %v", key, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, e.facts); err != nil {
+		return "", fmt.Errorf("failed to expand template in %s: %v", key, err)
+	}
+	return buf.String(), nil
+}
+
+// expandTemplates renders the templates in every string value of data.
+func expandTemplates(data map[string]interface{}) (map[string]interface{}, error) {
+	return mapStrings(data, (&expander{}).render)
+}
+
+// mapStrings replaces every string value in data with the result of calling fn with its key and value.
+func mapStrings(data map[string]interface{}, fn func(key, value string) (string, error)) (map[string]interface{}, error) {
+	result, err := mapValue("", data, fn)
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]interface{}), nil
+}
+
+func mapValue(key string, value interface{}, fn func(key, value string) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return fn(key, v)
+	case []string:
+		result := make([]string, 0, len(v))
+		for i, item := range v {
+			s, err := fn(fmt.Sprintf("%s[%d]", key, i), item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			newItem, err := mapValue(fmt.Sprintf("%s[%d]", key, i), item, fn)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, newItem)
+		}
+		return result, nil
+	case map[string]string:
+		result := make(map[string]string, len(v))
+		for k, item := range v {
+			s, err := fn(key+"."+k, item)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = s
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			newItem, err := mapValue(joinPath(key, convert.ToYAMLKey(k)), item, fn)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = newItem
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+func readTrimmed(path string) string {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes))
+}
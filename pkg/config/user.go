@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var userName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// Validate checks that the user can be created.
+func (u *User) Validate() error {
+	if !userName.MatchString(u.Name) || len(u.Name) > 32 {
+		return fmt.Errorf("invalid name %q", u.Name)
+	}
+	if u.Name == "root" || u.Name == "rancher" {
+		return fmt.Errorf("%s is not managed in users", u.Name)
+	}
+	if u.UID < 0 || u.GID < 0 {
+		return fmt.Errorf("uid and gid must not be negative")
+	}
+	if u.Password != "" && !strings.HasPrefix(u.Password, "$") {
+		return fmt.Errorf("password must be hashed, e.g. with openssl passwd -6")
+	}
+	if u.Shell != "" && !filepath.IsAbs(u.Shell) {
+		return fmt.Errorf("shell must be an absolute path")
+	}
+	if u.HomeDir != "" && !filepath.IsAbs(u.HomeDir) {
+		return fmt.Errorf("home_dir must be an absolute path")
+	}
+	for _, g := range u.Groups {
+		if !userName.MatchString(g) {
+			return fmt.Errorf("invalid group %q", g)
+		}
+	}
+	return ValidatePrincipals(u.SSHAuthorizedPrincipals)
+}
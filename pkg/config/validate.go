@@ -0,0 +1,409 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/rancher/mapper"
+	"github.com/rancher/mapper/convert"
+	"github.com/rancher/mapper/definition"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a single validation failure found in a config file.
+type Problem struct {
+	File    string
+	Path    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, p.Path, p.Message)
+}
+
+// ValidateFile checks the cloud-config at path against the CloudConfig schema.
+func ValidateFile(path string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Validate(path, data)
+}
+
+// Validate checks the cloud-config data, read from file, against the CloudConfig schema.
+// Unknown keys, type mismatches and unusable write_files entries are reported as problems.
+func Validate(file string, data []byte) ([]Problem, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	v := &validator{filename: file}
+	if len(doc.Content) > 0 {
+		v.object(schema, "", doc.Content[0])
+	}
+	return v.problems, nil
+}
+
+type validator struct {
+	filename string
+	problems []Problem
+}
+
+func (v *validator) problem(node *yaml.Node, path, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		File:    v.filename,
+		Path:    path,
+		Line:    node.Line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) object(s *mapper.Schema, path string, node *yaml.Node) {
+	node = resolve(node)
+	if node.Kind != yaml.MappingNode {
+		if !isNull(node) {
+			v.problem(node, pathOrRoot(path), "expected a map, got %s", kindOf(node))
+		}
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyPath := joinPath(path, key.Value)
+		if key.Value == "<<" {
+			continue
+		}
+		if path == "" && key.Value == mergeStrategyKey {
+			v.mergeStrategies(keyPath, value)
+			continue
+		}
+		name, ok := fieldName(s, key.Value)
+		if !ok {
+			if guess := suggest(s, key.Value); guess != "" {
+				v.problem(key, keyPath, "unknown key, did you mean %q?", guess)
+			} else {
+				v.problem(key, keyPath, "unknown key")
+			}
+			continue
+		}
+		v.field(s.ResourceFields[name].Type, keyPath, value)
+	}
+
+	switch s.ID {
+	case "file":
+		v.file(path, node)
+		v.entry(path, node, s.ID, &File{})
+	case "wifi":
+		v.entry(path, node, s.ID, &Wifi{})
+	case "user":
+		v.entry(path, node, s.ID, &User{})
+	case "ssh":
+		v.entry(path, node, s.ID, &SSH{})
+	case "module":
+		v.entry(path, node, s.ID, &Module{})
+	case "remoteFile":
+		v.entry(path, node, s.ID, &RemoteFile{})
+	case "http":
+		v.entry(path, node, s.ID, &HTTP{})
+	}
+}
+
+func knownStep(name string) bool {
+	if len(Steps) == 0 {
+		return true
+	}
+	for _, step := range Steps {
+		if step == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) field(fieldType, path string, node *yaml.Node) {
+	node = resolve(node)
+	if isNull(node) {
+		return
+	}
+
+	switch {
+	case fieldType == "string":
+		v.scalar(path, node, "!!str", "!!binary", "!!timestamp")
+		switch canonicalKey(strings.Split(path, ".")) {
+		case "ssh_authorized_keys_mode":
+			if node.Value != SSHKeysAppend && node.Value != SSHKeysManaged {
+				v.problem(node, path, "invalid mode %q, expected append or managed", node.Value)
+			}
+		case "k3os.ssh_key_timeout":
+			if _, err := time.ParseDuration(node.Value); err != nil {
+				v.problem(node, path, "invalid duration %q, expected e.g. 30s or 2m", node.Value)
+			}
+		}
+	case fieldType == "boolean":
+		if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!str" && node.Value != "true" && node.Value != "false" {
+			v.problem(node, path, "expected true or false, got %q", node.Value)
+			return
+		}
+		v.scalar(path, node, "!!bool", "!!str")
+	case fieldType == "int":
+		v.scalar(path, node, "!!int")
+	case fieldType == "array[string]":
+		if node.Kind == yaml.ScalarNode {
+			v.scalar(path, node, "!!str")
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			v.problem(node, path, "expected %s, got %s", fieldType, kindOf(node))
+			return
+		}
+		for i, item := range node.Content {
+			item = resolve(item)
+			v.scalar(fmt.Sprintf("%s[%d]", path, i), item, "!!str")
+			if canonicalKey(strings.Split(path, ".")) == "ssh_authorized_principals" && item.Kind == yaml.ScalarNode {
+				if err := ValidatePrincipals([]string{item.Value}); err != nil {
+					v.problem(item, fmt.Sprintf("%s[%d]", path, i), "%v", err)
+				}
+			}
+		}
+	case fieldType == "map[string]":
+		if node.Kind != yaml.MappingNode {
+			v.problem(node, path, "expected %s, got %s", fieldType, kindOf(node))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], resolve(node.Content[i+1])
+			if value.Kind != yaml.ScalarNode {
+				v.problem(value, joinPath(path, key.Value), "expected a scalar value, got %s", kindOf(value))
+			} else if canonicalKey(strings.Split(path, ".")) == "k3os.apply_policy" {
+				if value.Value != PolicyContinue && value.Value != PolicyWarn && value.Value != PolicyFatal {
+					v.problem(value, joinPath(path, key.Value), "invalid policy %q, expected continue, warn or fatal", value.Value)
+				}
+				if !knownStep(key.Value) {
+					v.problem(key, joinPath(path, key.Value), "unknown step %q, expected one of %s", key.Value, strings.Join(Steps, ", "))
+				}
+			}
+		}
+	case definition.IsArrayType(fieldType):
+		sub := schemas.Schema(definition.SubType(fieldType))
+		if node.Kind != yaml.SequenceNode {
+			v.problem(node, path, "expected %s, got %s", fieldType, kindOf(node))
+			return
+		}
+		for i, item := range node.Content {
+			if sub == nil {
+				v.field(definition.SubType(fieldType), fmt.Sprintf("%s[%d]", path, i), item)
+				continue
+			}
+			// k3os.modules entries can be "name options..." strings too
+			if sub.ID == "module" && resolve(item).Kind == yaml.ScalarNode {
+				v.scalar(fmt.Sprintf("%s[%d]", path, i), resolve(item), "!!str")
+				continue
+			}
+			v.object(sub, fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	default:
+		if sub := schemas.Schema(fieldType); sub != nil {
+			v.object(sub, path, node)
+		}
+	}
+}
+
+func (v *validator) mergeStrategies(path string, node *yaml.Node) {
+	node = resolve(node)
+	if node.Kind != yaml.MappingNode {
+		v.problem(node, path, "expected a map, got %s", kindOf(node))
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolve(node.Content[i+1])
+		if _, _, err := checkMergeStrategy(key.Value, value.Value); err != nil {
+			v.problem(value, joinPath(path, key.Value), "%v", strings.TrimPrefix(err.Error(), mergeStrategyKey+": "))
+		}
+	}
+}
+
+func (v *validator) scalar(path string, node *yaml.Node, tags ...string) {
+	if node.Kind != yaml.ScalarNode {
+		v.problem(node, path, "expected %s, got %s", tagNames[tags[0]], kindOf(node))
+		return
+	}
+	for _, tag := range tags {
+		if node.ShortTag() == tag {
+			return
+		}
+	}
+	v.problem(node, path, "expected %s, got %s %q", tagNames[tags[0]], kindOf(node), node.Value)
+}
+
+// file checks that a write_files entry can actually be written.
+func (v *validator) file(path string, node *yaml.Node) {
+	f := File{}
+	nodes := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, ok := fieldName(schemas.Schema("file"), node.Content[i].Value)
+		value := resolve(node.Content[i+1])
+		if name == "source" {
+			f.Source = &FileSource{}
+		}
+		if !ok || value.Kind != yaml.ScalarNode {
+			continue
+		}
+		nodes[name] = value
+		switch name {
+		case "content":
+			f.Content = value.Value
+		case "encoding":
+			f.Encoding = value.Value
+		case "permissions":
+			f.RawFilePermissions = value.Value
+		case "path":
+			f.Path = value.Value
+		case "sha256":
+			f.SHA256 = value.Value
+		}
+	}
+
+	if f.Path == "" {
+		v.problem(node, path, "missing path")
+	}
+	if perm, err := f.Permissions(); err != nil {
+		v.problem(nodes["permissions"], joinPath(path, "permissions"), "%v", err)
+	} else if perm&^07777 != 0 {
+		v.problem(nodes["permissions"], joinPath(path, "permissions"), "file permissions %q out of range", f.RawFilePermissions)
+	}
+	if content, err := util.DecodeContent(f.Content, f.Encoding); err != nil {
+		n, ok := nodes["encoding"]
+		if !ok {
+			n = nodes["content"]
+		}
+		v.problem(n, joinPath(path, "encoding"), "%v", err)
+	} else if _, ok := nodes["sha256"]; ok && f.Source == nil && checkSHA256(f.SHA256) == nil {
+		if err := f.VerifySHA256(content); err != nil {
+			v.problem(nodes["sha256"], joinPath(path, "sha256"), "%v", err)
+		}
+	}
+}
+
+type validatable interface {
+	Validate() error
+}
+
+// entry checks a list entry, such as a k3os.wifi network or a user, or a section such as k3os.ssh,
+// with its Validate method.
+func (v *validator) entry(path string, node *yaml.Node, schemaID string, into validatable) {
+	data := map[string]interface{}{}
+	if err := node.Decode(&data); err != nil {
+		return
+	}
+	// type mismatches have already been reported
+	if err := schemas.Schema(schemaID).Mapper.ToInternal(data); err != nil {
+		return
+	}
+	if err := convert.ToObj(data, into); err != nil {
+		return
+	}
+	if err := into.Validate(); err != nil {
+		v.problem(node, path, "%v", err)
+	}
+	// warnings do not make the config invalid, they are only logged
+	if w, ok := into.(interface{ Warnings() []string }); ok {
+		for _, warning := range w.Warnings() {
+			logrus.Warnf("%s:%d: %s: %s", v.filename, node.Line, path, warning)
+		}
+	}
+}
+
+var tagNames = map[string]string{
+	"!!str":  "string",
+	"!!bool": "boolean",
+	"!!int":  "int",
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null"
+}
+
+func kindOf(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "map"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	return strings.TrimPrefix(node.ShortTag(), "!!")
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// suggest returns the closest known key to a misspelled one, or "" if nothing is close.
+func suggest(s *mapper.Schema, key string) string {
+	var names []string
+	for name := range s.ResourceFields {
+		names = append(names, convert.ToYAMLKey(name))
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if d := distance(strings.ToLower(key), name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
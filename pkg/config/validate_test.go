@@ -0,0 +1,93 @@
+package config
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	defer func(steps []string) {
+		Steps = steps
+	}(Steps)
+	Steps = []string{"k3s", "modules"}
+
+	problems, err := Validate("test.yaml", []byte(`ssh_authorised_keys:
+- one...
+hostname: myhost
+k3os:
+  dns_nameserver: 8.8.8.8
+  labels:
+    region: [us-west-1]
+  k3s_args: {server: true}
+  apply_policy: {modules: fatal, k3s: abort, modlues: warn}
+  modules:
+  - kvm
+  - {name: nouveau, blacklist: true, load: true}
+  wifi:
+  - name: home
+    pass: secret
+  - name: office
+    eap: tls
+    client_cert_file: /etc/ssl/client.pem
+  ssh:
+    host_keys:
+    - type: dsa
+      certificate: ssh-dss-cert-v01@openssh.com AAAA
+  remote_files:
+  - url: ftp://example.com/images.tar
+    path: images.tar
+  http:
+    https_proxy: ftp://proxy.example.com
+write_files:
+- path: /etc/motd
+  permissions: "0999"
+- path: /etc/issue
+  encoding: b64
+  content: "not base64"
+- path: /etc/localtime
+  link_target: /usr/share/zoneinfo/UTC
+  content: UTC
+- path: /etc/motd
+  content: hello!
+  sha256: 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+- path: /var/lib/images.tar
+  source: {url: https://example.com/images.tar, sha256: 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03}
+  sha256: 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03
+users:
+- name: alice
+  sudo: true
+  password: plaintext
+ssh_authorized_keys_mode: owned
+ssh_authorized_principals: [ops team]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Problem{
+		{File: "test.yaml", Line: 1, Path: "ssh_authorised_keys"},
+		{File: "test.yaml", Line: 7, Path: "k3os.labels.region"},
+		{File: "test.yaml", Line: 8, Path: "k3os.k3s_args"},
+		{File: "test.yaml", Line: 9, Path: "k3os.apply_policy.k3s"},
+		{File: "test.yaml", Line: 9, Path: "k3os.apply_policy.modlues"},
+		{File: "test.yaml", Line: 12, Path: "k3os.modules[1]"},
+		{File: "test.yaml", Line: 16, Path: "k3os.wifi[1]"},
+		{File: "test.yaml", Line: 20, Path: "k3os.ssh"},
+		{File: "test.yaml", Line: 24, Path: "k3os.remote_files[0]"},
+		{File: "test.yaml", Line: 27, Path: "k3os.http"},
+		{File: "test.yaml", Line: 30, Path: "write_files[0].permissions"},
+		{File: "test.yaml", Line: 32, Path: "write_files[1].encoding"},
+		{File: "test.yaml", Line: 34, Path: "write_files[2]"},
+		{File: "test.yaml", Line: 39, Path: "write_files[3].sha256"},
+		{File: "test.yaml", Line: 40, Path: "write_files[4]"},
+		{File: "test.yaml", Line: 44, Path: "users[0]"},
+		{File: "test.yaml", Line: 47, Path: "ssh_authorized_keys_mode"},
+		{File: "test.yaml", Line: 48, Path: "ssh_authorized_principals[0]"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("got %d problems, expected %d: %v", len(problems), len(expected), problems)
+	}
+	for i, p := range problems {
+		p.Message = ""
+		if p != expected[i] {
+			t.Errorf("problem %d: got %v, expected %v", i, p, expected[i])
+		}
+	}
+}
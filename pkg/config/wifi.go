@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+)
+
+// Wifi security types, as understood by connman
+const (
+	WifiSecurityNone  = "none"
+	WifiSecurityWEP   = "wep"
+	WifiSecurityPSK   = "psk"
+	WifiSecurity8021X = "ieee8021x"
+)
+
+// WifiSecurity returns the security type of the network, which defaults to ieee8021x when an EAP
+// method is set and to psk otherwise.
+func (w *Wifi) WifiSecurity() string {
+	switch {
+	case w.Security != "":
+		return w.Security
+	case w.EAP != "":
+		return WifiSecurity8021X
+	}
+	return WifiSecurityPSK
+}
+
+// Warnings returns the settings of the network that connman ignores.
+func (w *Wifi) Warnings() []string {
+	if w.Priority != 0 {
+		return []string{"priority is ignored, connman does not prefer one configured network over another"}
+	}
+	return nil
+}
+
+// Validate checks that the network can be rendered into a usable connman service.
+func (w *Wifi) Validate() error {
+	if w.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+
+	switch w.WifiSecurity() {
+	case WifiSecurityNone:
+		if w.Passphrase != "" {
+			return fmt.Errorf("passphrase is not used with security none")
+		}
+	case WifiSecurityWEP, WifiSecurityPSK:
+		if w.Passphrase == "" {
+			return fmt.Errorf("missing passphrase")
+		}
+		if w.EAP != "" {
+			return fmt.Errorf("eap needs security %s", WifiSecurity8021X)
+		}
+	case WifiSecurity8021X:
+		if err := w.validateEAP(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid security %q, expected none, wep, psk or ieee8021x", w.Security)
+	}
+
+	for _, f := range []struct{ key, path string }{
+		{"ca_cert_file", w.CACertFile},
+		{"client_cert_file", w.ClientCertFile},
+		{"private_key_file", w.PrivateKeyFile},
+	} {
+		if f.path != "" && !filepath.IsAbs(f.path) {
+			return fmt.Errorf("%s must be an absolute path", f.key)
+		}
+	}
+
+	var ipv4, ipv6 int
+	for _, addr := range w.Addresses {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil {
+			return fmt.Errorf("invalid address %q, expected an address with a prefix length", addr)
+		}
+		if ip.To4() != nil {
+			ipv4++
+		} else {
+			ipv6++
+		}
+	}
+	if ipv4 > 1 || ipv6 > 1 {
+		return fmt.Errorf("at most one IPv4 and one IPv6 address can be set")
+	}
+	if w.Gateway != "" && (ipv4 == 0 || net.ParseIP(w.Gateway) == nil || net.ParseIP(w.Gateway).To4() == nil) {
+		return fmt.Errorf("gateway needs an IPv4 address and must be an IPv4 address itself")
+	}
+	if w.Gateway6 != "" && (ipv6 == 0 || net.ParseIP(w.Gateway6) == nil || net.ParseIP(w.Gateway6).To4() != nil) {
+		return fmt.Errorf("gateway6 needs an IPv6 address and must be an IPv6 address itself")
+	}
+	for _, ns := range w.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	return nil
+}
+
+func (w *Wifi) validateEAP() error {
+	switch w.EAP {
+	case "tls":
+		if w.ClientCertFile == "" || w.PrivateKeyFile == "" {
+			return fmt.Errorf("eap tls needs client_cert_file and private_key_file")
+		}
+		if w.Phase2 != "" {
+			return fmt.Errorf("phase2 is only used with eap peap or ttls")
+		}
+	case "peap", "ttls":
+		if w.Identity == "" || w.Passphrase == "" {
+			return fmt.Errorf("eap %s needs an identity and passphrase", w.EAP)
+		}
+	case "":
+		return fmt.Errorf("security %s needs eap", WifiSecurity8021X)
+	default:
+		return fmt.Errorf("invalid eap %q, expected tls, peap or ttls", w.EAP)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWifiValidate(t *testing.T) {
+	tests := []struct {
+		wifi Wifi
+		err  string
+	}{
+		{Wifi{Name: "home", Passphrase: "secret"}, ""},
+		{Wifi{Name: "guest", Security: "none", Hidden: true}, ""},
+		{Wifi{Name: "office", EAP: "peap", Identity: "user", Passphrase: "secret", Phase2: "MSCHAPV2"}, ""},
+		{Wifi{Name: "office", EAP: "tls", ClientCertFile: "/etc/ssl/client.pem", PrivateKeyFile: "/etc/ssl/client.key"}, ""},
+		{Wifi{Name: "static", Passphrase: "secret", Addresses: []string{"10.0.0.5/24", "2001:db8::5/64"}, Gateway: "10.0.0.1", Nameservers: []string{"10.0.0.53"}}, ""},
+		{Wifi{Passphrase: "secret"}, "missing name"},
+		{Wifi{Name: "home"}, "missing passphrase"},
+		{Wifi{Name: "guest", Security: "none", Passphrase: "secret"}, "not used"},
+		{Wifi{Name: "home", Security: "wpa3", Passphrase: "secret"}, "invalid security"},
+		{Wifi{Name: "office", Security: "psk", Passphrase: "secret", EAP: "peap"}, "eap needs security"},
+		{Wifi{Name: "office", Security: "ieee8021x"}, "needs eap"},
+		{Wifi{Name: "office", EAP: "tls", ClientCertFile: "/etc/ssl/client.pem"}, "private_key_file"},
+		{Wifi{Name: "office", EAP: "peap", Passphrase: "secret"}, "identity"},
+		{Wifi{Name: "office", EAP: "leap", Identity: "user"}, "invalid eap"},
+		{Wifi{Name: "office", EAP: "tls", ClientCertFile: "client.pem", PrivateKeyFile: "/etc/ssl/client.key"}, "absolute path"},
+		{Wifi{Name: "static", Passphrase: "secret", Addresses: []string{"10.0.0.5"}}, "invalid address"},
+		{Wifi{Name: "static", Passphrase: "secret", Addresses: []string{"10.0.0.5/24", "10.0.0.6/24"}}, "at most one"},
+		{Wifi{Name: "static", Passphrase: "secret", Gateway: "10.0.0.1"}, "gateway needs"},
+		{Wifi{Name: "static", Passphrase: "secret", Nameservers: []string{"dns"}}, "invalid nameserver"},
+	}
+	for _, test := range tests {
+		err := test.wifi.Validate()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: got %v, expected %q", test.wifi, err, test.err)
+		}
+	}
+}
+
+func TestWifiWarnings(t *testing.T) {
+	w := Wifi{Name: "home", Passphrase: "secret"}
+	if warnings := w.Warnings(); len(warnings) != 0 {
+		t.Errorf("got warnings %v for a network without priority", warnings)
+	}
+	w.Priority = 10
+	if err := w.Validate(); err != nil {
+		t.Errorf("priority made the network invalid: %v", err)
+	}
+	if warnings := w.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "priority") {
+		t.Errorf("got warnings %v, expected one about priority", warnings)
+	}
+}
@@ -2,41 +2,109 @@ package module
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/paultag/go-modprobe"
 	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/util"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
-const (
+var (
 	procModulesFile = "/proc/modules"
+	// ModprobeConfig holds the blacklist, options and softdeps of k3os.modules, for the modules that
+	// are loaded by hotplug as well as those loaded by k3OS
+	ModprobeConfig = "/etc/modprobe.d/k3os.conf"
 )
 
+// LoadModules writes ModprobeConfig and loads the modules of cfg that are not loaded yet.
 func LoadModules(cfg *config.CloudConfig) error {
+	var errs []error
+	if err := WriteConfig(cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	modules, err := Pending(cfg)
+	if err != nil {
+		return err
+	}
+	for _, m := range modules {
+		logrus.Debugf("module %s with parameters [%s] is loading", m.Name, m.Options)
+		if err := modprobe.Load(m.Name, m.Options); err != nil {
+			errs = append(errs, fmt.Errorf("could not load module %s with parameters [%s], err %v", m.Name, m.Options, err))
+			continue
+		}
+		logrus.Debugf("module %s is loaded", m.Name)
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+// Config returns the content of ModprobeConfig for cfg, which is empty if no module needs one.
+func Config(cfg *config.CloudConfig) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, m := range cfg.K3OS.Modules {
+		if err := m.Validate(); err != nil {
+			return nil, fmt.Errorf("module %s: %v", m.Name, err)
+		}
+		if m.Blacklist {
+			fmt.Fprintf(buf, "blacklist %s\n", m.Name)
+		}
+		if m.Options != "" {
+			fmt.Fprintf(buf, "options %s %s\n", m.Name, m.Options)
+		}
+		if m.Softdep != "" {
+			fmt.Fprintf(buf, "softdep %s %s\n", m.Name, m.Softdep)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+	return append([]byte("# written by k3os from k3os.modules\n"), buf.Bytes()...), nil
+}
+
+// WriteConfig writes ModprobeConfig, or removes it if no module needs one.
+func WriteConfig(cfg *config.CloudConfig) error {
+	content, err := Config(cfg)
+	if err != nil {
+		return err
+	}
+	if len(content) == 0 {
+		if err := os.Remove(ModprobeConfig); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(ModprobeConfig), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(ModprobeConfig, content, 0644)
+}
+
+// Pending returns the modules in cfg that should be loaded and are not loaded yet.
+func Pending(cfg *config.CloudConfig) ([]config.Module, error) {
 	loaded := map[string]bool{}
 	f, err := os.Open(procModulesFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 	sc := bufio.NewScanner(f)
 	for sc.Scan() {
 		loaded[strings.SplitN(sc.Text(), " ", 2)[0]] = true
 	}
-	modules := cfg.K3OS.Modules
-	for _, m := range modules {
-		if loaded[m] {
-			continue
-		}
-		params := strings.SplitN(m, " ", -1)
-		logrus.Debugf("module %s with parameters [%s] is loading", m, params)
-		if err := modprobe.Load(params[0], strings.Join(params[1:], " ")); err != nil {
-			return fmt.Errorf("could not load module %s with parameters [%s], err %v", m, params, err)
+	var pending []config.Module
+	for _, m := range cfg.K3OS.Modules {
+		if m.ShouldLoad() && !loaded[strings.Replace(m.Name, "-", "_", -1)] {
+			pending = append(pending, m)
 		}
-		logrus.Debugf("module %s is loaded", m)
 	}
-	return sc.Err()
+	return pending, sc.Err()
 }
@@ -0,0 +1,112 @@
+package module
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3os/pkg/config"
+)
+
+func modulesConfig(modules ...config.Module) *config.CloudConfig {
+	return &config.CloudConfig{K3OS: config.K3OS{Modules: modules}}
+}
+
+func TestConfig(t *testing.T) {
+	no := false
+	tests := []struct {
+		name     string
+		modules  []config.Module
+		expected string
+		err      string
+	}{
+		{
+			name:    "nothing to configure",
+			modules: []config.Module{{Name: "kvm"}, {Name: "i915", Load: &no}},
+		},
+		{
+			name: "blacklist, options and softdep",
+			modules: []config.Module{
+				{Name: "nouveau", Blacklist: true},
+				{Name: "nvme_core", Options: "multipath=0"},
+				{Name: "ext4", Softdep: "pre: crc32c"},
+				{Name: "i915", Options: "enable_guc=2", Softdep: "post: drm"},
+			},
+			expected: "# written by k3os from k3os.modules\n" +
+				"blacklist nouveau\n" +
+				"options nvme_core multipath=0\n" +
+				"softdep ext4 pre: crc32c\n" +
+				"options i915 enable_guc=2\n" +
+				"softdep i915 post: drm\n",
+		},
+		{
+			name:    "invalid softdep",
+			modules: []config.Module{{Name: "ext4", Softdep: "crc32c"}},
+			err:     "module ext4: invalid softdep",
+		},
+		{
+			name:    "invalid name",
+			modules: []config.Module{{Name: "../kvm", Blacklist: true}},
+			err:     "invalid name",
+		},
+	}
+	for _, tt := range tests {
+		content, err := Config(modulesConfig(tt.modules...))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, expected %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(content) != tt.expected {
+			t.Errorf("%s: got %q, %v, expected %q", tt.name, content, err, tt.expected)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	defer func(path string) { ModprobeConfig = path }(ModprobeConfig)
+	ModprobeConfig = filepath.Join(t.TempDir(), "modprobe.d", "k3os.conf")
+
+	if err := WriteConfig(modulesConfig(config.Module{Name: "nouveau", Blacklist: true})); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(ModprobeConfig); err != nil || !strings.Contains(string(got), "blacklist nouveau\n") {
+		t.Errorf("got %q, %v, expected the blacklist", got, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := WriteConfig(modulesConfig(config.Module{Name: "kvm"})); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(ModprobeConfig); !os.IsNotExist(err) {
+			t.Errorf("got %v, expected the config to be removed", err)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	defer func(path string) { procModulesFile = path }(procModulesFile)
+	procModulesFile = filepath.Join(t.TempDir(), "modules")
+	modules := "kvm 806912 1 kvm_intel, Live 0x0000000000000000\nnvme_core 118784 2 nvme, Live 0x0000000000000000\n"
+	if err := ioutil.WriteFile(procModulesFile, []byte(modules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	no := false
+	pending, err := Pending(modulesConfig(
+		config.Module{Name: "kvm"},
+		config.Module{Name: "nvme-core"},
+		config.Module{Name: "wireguard"},
+		config.Module{Name: "nouveau", Blacklist: true},
+		config.Module{Name: "i915", Load: &no},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []config.Module{{Name: "wireguard"}}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("got %+v, expected %+v", pending, expected)
+	}
+}
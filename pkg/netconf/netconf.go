@@ -0,0 +1,437 @@
+package netconf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/urfave/cli"
+	"github.com/vishvananda/netlink"
+)
+
+const SysClassNet = "/sys/class/net"
+
+// Netlink is the part of the netlink API used to configure interfaces, so that it can be replaced in tests.
+type Netlink interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	RouteReplace(route *netlink.Route) error
+}
+
+// Configurator configures interfaces through netlink, and through sysfs for the bond and bridge settings
+// that netlink cannot change.
+type Configurator struct {
+	nl    Netlink
+	sysfs string
+}
+
+// NewConfigurator returns a Configurator using nl, with sysfs being the path of /sys/class/net.
+func NewConfigurator(nl Netlink, sysfs string) *Configurator {
+	return &Configurator{
+		nl:    nl,
+		sysfs: sysfs,
+	}
+}
+
+// Loopback brings up the loopback interface of the current network namespace.
+func Loopback() error {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	return NewConfigurator(h, SysClassNet).Loopback()
+}
+
+// ConfigureNetwork creates and configures the interfaces declared in k3os.network, in the order listed.
+func ConfigureNetwork(cfg *config.CloudConfig) error {
+	if cfg.K3OS.Network == nil || len(cfg.K3OS.Network.Interfaces) == 0 {
+		return nil
+	}
+
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+	c := NewConfigurator(h, SysClassNet)
+
+	var errs []error
+	if err := CheckUnmanaged(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	for _, iface := range cfg.K3OS.Network.Interfaces {
+		if err := c.Interface(iface); err != nil {
+			errs = append(errs, fmt.Errorf("failed to configure interface %s: %v", iface.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+// Unmanaged returns the interfaces that connman should leave alone: those with static addresses,
+// along with the members of bonds and bridges.
+func Unmanaged(cfg *config.CloudConfig) []string {
+	if cfg.K3OS.Network == nil {
+		return nil
+	}
+
+	var names []string
+	for _, iface := range cfg.K3OS.Network.Interfaces {
+		if !iface.DHCP {
+			names = append(names, iface.Name)
+		}
+		if iface.Bond != nil {
+			names = append(names, iface.Bond.Slaves...)
+		}
+		if iface.Bridge != nil {
+			names = append(names, iface.Bridge.Ports...)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckUnmanaged reports the interfaces of k3os.network that are left to connman, but that connman
+// ignores anyway since its blacklist matches names by prefix, e.g. eth10 when eth1 is unmanaged.
+func CheckUnmanaged(cfg *config.CloudConfig) error {
+	if cfg.K3OS.Network == nil {
+		return nil
+	}
+	unmanaged := Unmanaged(cfg)
+	isUnmanaged := map[string]bool{}
+	for _, name := range unmanaged {
+		isUnmanaged[name] = true
+	}
+
+	var errs []error
+	for _, iface := range cfg.K3OS.Network.Interfaces {
+		names := []string{iface.Name}
+		if iface.VLAN != nil {
+			names = append(names, iface.VLAN.Link)
+		}
+		for _, name := range names {
+			if name == "" || isUnmanaged[name] {
+				continue
+			}
+			for _, prefix := range unmanaged {
+				if strings.HasPrefix(name, prefix) {
+					errs = append(errs, fmt.Errorf("interface %s is left to connman, but connman also ignores it since %s is unmanaged", name, prefix))
+					break
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+// Validate checks an interface before anything is changed.
+func Validate(iface config.NetworkInterface) error {
+	if iface.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	kinds := 0
+	for _, set := range []bool{iface.Bond != nil, iface.VLAN != nil, iface.Bridge != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return fmt.Errorf("only one of bond, vlan and bridge can be set")
+	}
+	if iface.Bond != nil && iface.Bond.Mode != "" && netlink.StringToBondMode(iface.Bond.Mode) == netlink.BOND_MODE_UNKNOWN {
+		return fmt.Errorf("invalid bond mode %q", iface.Bond.Mode)
+	}
+	if iface.VLAN != nil && (iface.VLAN.Link == "" || iface.VLAN.ID < 1 || iface.VLAN.ID > 4094) {
+		return fmt.Errorf("vlan needs a link and an id between 1 and 4094")
+	}
+	for _, addr := range iface.Addresses {
+		if _, err := netlink.ParseAddr(addr); err != nil {
+			return fmt.Errorf("invalid address %q, expected an address with a prefix length", addr)
+		}
+	}
+	if iface.Gateway != "" && (net.ParseIP(iface.Gateway) == nil || net.ParseIP(iface.Gateway).To4() == nil) {
+		return fmt.Errorf("invalid IPv4 gateway %q", iface.Gateway)
+	}
+	if iface.Gateway6 != "" && (net.ParseIP(iface.Gateway6) == nil || net.ParseIP(iface.Gateway6).To4() != nil) {
+		return fmt.Errorf("invalid IPv6 gateway %q", iface.Gateway6)
+	}
+	for _, r := range iface.Routes {
+		if _, _, err := net.ParseCIDR(r.To); err != nil && r.To != "default" {
+			return fmt.Errorf("invalid route destination %q", r.To)
+		}
+		if r.To == "default" && r.Via == "" {
+			return fmt.Errorf("default route needs a gateway")
+		}
+		if r.Via != "" && net.ParseIP(r.Via) == nil {
+			return fmt.Errorf("invalid route gateway %q", r.Via)
+		}
+	}
+	return nil
+}
+
+// Loopback brings up lo with 127.0.0.1/8 and verifies that it is up.
+func (c *Configurator) Loopback() error {
+	lo, err := c.nl.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to find lo: %v", err)
+	}
+	if err := c.nl.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("failed to bring up lo: %v", err)
+	}
+	addr, _ := netlink.ParseAddr("127.0.0.1/8")
+	addr.Scope = int(netlink.SCOPE_HOST)
+	if err := c.nl.AddrReplace(lo, addr); err != nil {
+		return fmt.Errorf("failed to add %s to lo: %v", addr.IPNet, err)
+	}
+	_, dst, _ := net.ParseCIDR("127.0.0.0/8")
+	if err := c.nl.RouteReplace(&netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_HOST,
+	}); err != nil {
+		return fmt.Errorf("failed to add route to %s: %v", dst, err)
+	}
+	return c.verify(config.NetworkInterface{
+		Name:      "lo",
+		Addresses: []string{"127.0.0.1/8"},
+	})
+}
+
+// Interface creates and configures an interface, then verifies that it is up with the declared MTU,
+// addresses and members.
+func (c *Configurator) Interface(iface config.NetworkInterface) error {
+	if err := Validate(iface); err != nil {
+		return err
+	}
+
+	link, err := c.link(iface)
+	if err != nil {
+		return err
+	}
+	if iface.Bond != nil {
+		if err := c.bond(link, iface.Bond); err != nil {
+			return err
+		}
+	}
+	if iface.Bridge != nil {
+		if err := c.bridge(link, iface.Bridge); err != nil {
+			return err
+		}
+	}
+
+	if iface.MTU > 0 && link.Attrs().MTU != iface.MTU {
+		if err := c.nl.LinkSetMTU(link, iface.MTU); err != nil {
+			return fmt.Errorf("failed to set mtu %d: %v", iface.MTU, err)
+		}
+	}
+	if err := c.nl.LinkSetUp(link); err != nil {
+		return fmt.Errorf("failed to bring up link: %v", err)
+	}
+	for _, a := range iface.Addresses {
+		addr, _ := netlink.ParseAddr(a)
+		if err := c.nl.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("failed to add address %s: %v", a, err)
+		}
+	}
+
+	routes := iface.Routes
+	if iface.Gateway != "" {
+		routes = append([]config.NetworkRoute{{To: "default", Via: iface.Gateway}}, routes...)
+	}
+	if iface.Gateway6 != "" {
+		routes = append([]config.NetworkRoute{{To: "default", Via: iface.Gateway6}}, routes...)
+	}
+	for _, r := range routes {
+		if err := c.nl.RouteReplace(route(link, r)); err != nil {
+			return fmt.Errorf("failed to add route to %s: %v", r.To, err)
+		}
+	}
+
+	return c.verify(iface)
+}
+
+// link returns the interface, creating it first if it is a bond, vlan or bridge that does not exist yet.
+func (c *Configurator) link(iface config.NetworkInterface) (netlink.Link, error) {
+	link, err := c.nl.LinkByName(iface.Name)
+	if _, notFound := err.(netlink.LinkNotFoundError); err == nil || !notFound {
+		return link, err
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = iface.Name
+	switch {
+	case iface.Bond != nil:
+		bond := netlink.NewLinkBond(attrs)
+		if iface.Bond.Mode != "" {
+			bond.Mode = netlink.StringToBondMode(iface.Bond.Mode)
+		}
+		link = bond
+	case iface.VLAN != nil:
+		parent, err := c.nl.LinkByName(iface.VLAN.Link)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find vlan link %s: %v", iface.VLAN.Link, err)
+		}
+		attrs.ParentIndex = parent.Attrs().Index
+		link = &netlink.Vlan{LinkAttrs: attrs, VlanId: iface.VLAN.ID}
+	case iface.Bridge != nil:
+		link = &netlink.Bridge{LinkAttrs: attrs}
+	default:
+		return nil, err
+	}
+
+	if err := c.nl.LinkAdd(link); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", link.Type(), err)
+	}
+	return c.nl.LinkByName(iface.Name)
+}
+
+func (c *Configurator) bond(link netlink.Link, bond *config.NetworkBond) error {
+	bonding := filepath.Join(c.sysfs, link.Attrs().Name, "bonding")
+	// the mode can only be changed while the bond is down and has no slaves
+	if current, ok := link.(*netlink.Bond); ok && bond.Mode != "" && current.Mode != netlink.StringToBondMode(bond.Mode) {
+		if err := c.nl.LinkSetDown(link); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(bonding, "mode"), []byte(bond.Mode), 0644); err != nil {
+			return fmt.Errorf("failed to set bond mode %s: %v", bond.Mode, err)
+		}
+	}
+
+	keys := make([]string, 0, len(bond.Options))
+	for k := range bond.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := ioutil.WriteFile(filepath.Join(bonding, k), []byte(bond.Options[k]), 0644); err != nil {
+			return fmt.Errorf("failed to set bonding option %s: %v", k, err)
+		}
+	}
+
+	// a slave must be down to be added to a bond
+	return c.members(link, bond.Slaves, true)
+}
+
+func (c *Configurator) bridge(link netlink.Link, bridge *config.NetworkBridge) error {
+	stp := filepath.Join(c.sysfs, link.Attrs().Name, "bridge", "stp_state")
+	want := "0"
+	if bridge.STP {
+		want = "1"
+	}
+	current, err := ioutil.ReadFile(stp)
+	if err != nil && !bridge.STP {
+		// stp is off for new bridges
+		return c.members(link, bridge.Ports, false)
+	}
+	if strings.TrimSpace(string(current)) != want {
+		if err := ioutil.WriteFile(stp, []byte(want), 0644); err != nil {
+			return fmt.Errorf("failed to set stp: %v", err)
+		}
+	}
+	return c.members(link, bridge.Ports, false)
+}
+
+func (c *Configurator) members(master netlink.Link, names []string, down bool) error {
+	for _, name := range names {
+		member, err := c.nl.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find %s: %v", name, err)
+		}
+		if member.Attrs().MasterIndex != master.Attrs().Index {
+			if down {
+				if err := c.nl.LinkSetDown(member); err != nil {
+					return fmt.Errorf("failed to bring down %s: %v", name, err)
+				}
+			}
+			if err := c.nl.LinkSetMasterByIndex(member, master.Attrs().Index); err != nil {
+				return fmt.Errorf("failed to add %s to %s: %v", name, master.Attrs().Name, err)
+			}
+		}
+		if err := c.nl.LinkSetUp(member); err != nil {
+			return fmt.Errorf("failed to bring up %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// verify reads the interface back and checks that it is in the declared state.
+func (c *Configurator) verify(iface config.NetworkInterface) error {
+	link, err := c.nl.LinkByName(iface.Name)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		errs = append(errs, fmt.Errorf("%s is not up", iface.Name))
+	}
+	if iface.MTU > 0 && link.Attrs().MTU != iface.MTU {
+		errs = append(errs, fmt.Errorf("%s has mtu %d instead of %d", iface.Name, link.Attrs().MTU, iface.MTU))
+	}
+
+	addrs, err := c.nl.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, a := range iface.Addresses {
+		want, _ := netlink.ParseAddr(a)
+		found := false
+		for _, addr := range addrs {
+			found = found || addr.Equal(*want)
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("%s is missing address %s", iface.Name, a))
+		}
+	}
+
+	var members []string
+	if iface.Bond != nil {
+		members = iface.Bond.Slaves
+	} else if iface.Bridge != nil {
+		members = iface.Bridge.Ports
+	}
+	for _, name := range members {
+		member, err := c.nl.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		if member.Attrs().MasterIndex != link.Attrs().Index {
+			errs = append(errs, fmt.Errorf("%s is not a member of %s", name, iface.Name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+func route(link netlink.Link, r config.NetworkRoute) *netlink.Route {
+	result := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        net.ParseIP(r.Via),
+		Priority:  r.Metric,
+	}
+	if r.To != "default" {
+		_, result.Dst, _ = net.ParseCIDR(r.To)
+	}
+	if r.Via == "" {
+		result.Scope = netlink.SCOPE_LINK
+	}
+	return result
+}
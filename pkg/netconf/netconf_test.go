@@ -0,0 +1,226 @@
+package netconf
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newNamespace returns a handle to a new network namespace, skipping the test if it cannot be created.
+func newNamespace(t *testing.T) *netlink.Handle {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("failed to create a network namespace: %v", err)
+	}
+	defer ns.Close()
+	if err := netns.Set(orig); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Delete)
+	return h
+}
+
+func TestLoopback(t *testing.T) {
+	h := newNamespace(t)
+	c := NewConfigurator(h, t.TempDir())
+
+	// running it again must not fail on the existing address and route
+	for i := 0; i < 2; i++ {
+		if err := c.Loopback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lo.Attrs().Flags&net.FlagUp == 0 {
+		t.Error("lo is not up")
+	}
+	routes, err := h.RouteList(lo, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || routes[0].Dst.String() != "127.0.0.0/8" {
+		t.Errorf("got routes %v, expected a route to 127.0.0.0/8", routes)
+	}
+}
+
+// addLink creates a link, skipping the test if the kernel does not support its type.
+func addLink(t *testing.T, h *netlink.Handle, link netlink.Link) {
+	if err := h.LinkAdd(link); err == unix.EOPNOTSUPP {
+		t.Skipf("%s links are not supported: %v", link.Type(), err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterface(t *testing.T) {
+	h := newNamespace(t)
+	c := NewConfigurator(h, t.TempDir())
+	addLink(t, h, &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"})
+
+	ifaces := []config.NetworkInterface{
+		{
+			Name:      "veth1",
+			MTU:       1400,
+			Addresses: []string{"10.0.1.5/24", "2001:db8::5/64"},
+			Gateway:   "10.0.1.1",
+			Routes:    []config.NetworkRoute{{To: "10.1.0.0/16", Via: "10.0.1.254", Metric: 10}},
+		},
+		{
+			Name:      "br0",
+			Bridge:    &config.NetworkBridge{Ports: []string{"veth0"}},
+			Addresses: []string{"192.168.0.1/24"},
+		},
+	}
+	// running it again must leave the interfaces as they are
+	for i := 0; i < 2; i++ {
+		for _, iface := range ifaces {
+			if err := c.Interface(iface); err != nil {
+				t.Fatalf("%s: %v", iface.Name, err)
+			}
+		}
+	}
+
+	veth, err := h.LinkByName("veth1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := h.RouteList(veth, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var via []string
+	for _, r := range routes {
+		if r.Gw != nil {
+			via = append(via, r.Gw.String())
+		}
+	}
+	if strings.Join(via, " ") != "10.0.1.1 10.0.1.254" {
+		t.Errorf("got routes via %v, expected the gateway and 10.0.1.254", via)
+	}
+}
+
+func TestVLAN(t *testing.T) {
+	h := newNamespace(t)
+	c := NewConfigurator(h, t.TempDir())
+	addLink(t, h, &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"})
+	link, err := h.LinkByName("veth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLink(t, h, &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "probe", ParentIndex: link.Attrs().Index}, VlanId: 1})
+
+	iface := config.NetworkInterface{
+		Name:      "veth0.100",
+		VLAN:      &config.NetworkVLAN{Link: "veth0", ID: 100},
+		Addresses: []string{"10.0.100.5/24"},
+	}
+	if err := c.Interface(iface); err != nil {
+		t.Fatal(err)
+	}
+	vlan, err := h.LinkByName("veth0.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := vlan.(*netlink.Vlan); !ok || v.VlanId != 100 {
+		t.Errorf("got %v, expected vlan 100", vlan)
+	}
+}
+
+func TestInterfaceMissingLink(t *testing.T) {
+	h := newNamespace(t)
+	c := NewConfigurator(h, t.TempDir())
+
+	err := c.Interface(config.NetworkInterface{Name: "eth9", Addresses: []string{"10.0.0.1/24"}})
+	if err == nil {
+		t.Fatal("expected an error for a missing interface")
+	}
+}
+
+// downNetlink never brings a link up, as happens when a driver refuses to.
+type downNetlink struct {
+	Netlink
+}
+
+func (downNetlink) LinkSetUp(link netlink.Link) error {
+	return nil
+}
+
+func TestLoopbackVerify(t *testing.T) {
+	h := newNamespace(t)
+	c := NewConfigurator(downNetlink{h}, t.TempDir())
+
+	err := c.Loopback()
+	if err == nil || !strings.Contains(err.Error(), "lo is not up") {
+		t.Fatalf("got %v, expected lo to be reported as down", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		iface config.NetworkInterface
+		err   string
+	}{
+		{config.NetworkInterface{Name: "eth0", Addresses: []string{"10.0.0.1/24"}, Gateway: "10.0.0.254"}, ""},
+		{config.NetworkInterface{Addresses: []string{"10.0.0.1/24"}}, "missing name"},
+		{config.NetworkInterface{Name: "eth0", Addresses: []string{"10.0.0.1"}}, "invalid address"},
+		{config.NetworkInterface{Name: "eth0", Gateway: "2001:db8::1"}, "invalid IPv4 gateway"},
+		{config.NetworkInterface{Name: "eth0", Gateway6: "10.0.0.1"}, "invalid IPv6 gateway"},
+		{config.NetworkInterface{Name: "eth0", Routes: []config.NetworkRoute{{To: "default"}}}, "needs a gateway"},
+		{config.NetworkInterface{Name: "bond0", Bond: &config.NetworkBond{Mode: "fast"}}, "invalid bond mode"},
+		{config.NetworkInterface{Name: "eth0.1", VLAN: &config.NetworkVLAN{Link: "eth0", ID: 4095}}, "between 1 and 4094"},
+		{config.NetworkInterface{Name: "x", VLAN: &config.NetworkVLAN{Link: "eth0", ID: 1}, Bridge: &config.NetworkBridge{}}, "only one of"},
+	}
+	for _, test := range tests {
+		err := Validate(test.iface)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, expected %q", test.iface.Name, err, test.err)
+		}
+	}
+}
+
+func TestCheckUnmanaged(t *testing.T) {
+	tests := []struct {
+		interfaces []config.NetworkInterface
+		err        string
+	}{
+		{[]config.NetworkInterface{{Name: "eth1", Addresses: []string{"10.0.0.1/24"}}, {Name: "eth10", Addresses: []string{"10.0.1.1/24"}}}, ""},
+		{[]config.NetworkInterface{{Name: "eth1", Addresses: []string{"10.0.0.1/24"}}, {Name: "eth2", DHCP: true}}, ""},
+		{[]config.NetworkInterface{{Name: "eth1", Addresses: []string{"10.0.0.1/24"}}, {Name: "eth10", DHCP: true}}, "interface eth10 is left to connman"},
+		{[]config.NetworkInterface{{Name: "eth0", Addresses: []string{"10.0.0.1/24"}}, {Name: "eth0.100", DHCP: true, VLAN: &config.NetworkVLAN{Link: "eth0", ID: 100}}}, "interface eth0.100 is left to connman"},
+		{[]config.NetworkInterface{{Name: "bond0", DHCP: true, Bond: &config.NetworkBond{Slaves: []string{"eth1"}}}, {Name: "eth1.5", DHCP: true, VLAN: &config.NetworkVLAN{Link: "eth12", ID: 5}}}, "interface eth12 is left to connman"},
+	}
+	for i, test := range tests {
+		err := CheckUnmanaged(&config.CloudConfig{K3OS: config.K3OS{Network: &config.Network{Interfaces: test.interfaces}}})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%d: got %v, expected %q", i, err, test.err)
+		}
+	}
+}
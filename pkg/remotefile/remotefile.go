@@ -0,0 +1,208 @@
+package remotefile
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/system"
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Cache holds the last good download of each URL, so that the files can be put in place while offline.
+var Cache = system.LocalPath("remote-files")
+
+// FetchRemoteFiles puts each of k3os.remote_files in place, downloading them withNet and otherwise
+// using the cached copies. A file that cannot be downloaded falls back to its cached copy.
+func FetchRemoteFiles(cfg *config.CloudConfig, withNet bool) error {
+	var errs []error
+	for i, r := range cfg.K3OS.RemoteFiles {
+		if err := fetchRemoteFile(r, withNet); err != nil {
+			errs = append(errs, fmt.Errorf("remote_files[%d] %s: %v", i, r.Path, err))
+		}
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+func fetchRemoteFile(r config.RemoteFile, withNet bool) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	perm, err := r.Permissions()
+	if err != nil {
+		return err
+	}
+	if r.SHA256 != "" && Current(r) {
+		return os.Chmod(r.Path, perm)
+	}
+
+	cached := CachePath(r.URL)
+	if withNet {
+		if err := download(r, cached); err != nil {
+			if _, statErr := os.Stat(cached); statErr != nil {
+				return err
+			}
+			logrus.Warnf("failed to download %s, using the copy downloaded before: %v", r.URL, err)
+		}
+	}
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		logrus.Debugf("not downloading %s for %s without the network", r.URL, r.Path)
+		return nil
+	}
+	if r.SHA256 != "" {
+		// the cache may hold the download of a previous sha256
+		if sum, err := fileSHA256(cached); err != nil || sum != strings.ToLower(r.SHA256) {
+			return fmt.Errorf("the copy of %s downloaded before does not have sha256 %s", r.URL, r.SHA256)
+		}
+	}
+	return install(cached, r.Path, perm)
+}
+
+// CachePath returns where the last good download of url is kept.
+func CachePath(url string) string {
+	return filepath.Join(Cache, fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+}
+
+// Current reports whether the file at the path of r already has its sha256.
+func Current(r config.RemoteFile) bool {
+	sum, err := fileSHA256(r.Path)
+	return err == nil && sum == strings.ToLower(r.SHA256)
+}
+
+// download fetches r into the cache, retrying as k3os.http configures, and only replaces the cached copy
+// once the download is complete and has the expected sha256.
+func download(r config.RemoteFile, cached string) error {
+	header, err := authHeader(r.AuthHeaderFile)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Cache, 0700); err != nil {
+		return err
+	}
+
+	return util.Retry(context.Background(), "download "+r.URL, func() error {
+		return get(r, header, cached)
+	})
+}
+
+func get(r config.RemoteFile, header http.Header, cached string) error {
+	req, err := http.NewRequest(http.MethodGet, r.URL, nil)
+	if err != nil {
+		return util.Permanent(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := util.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := util.StatusError(r.URL, resp); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(Cache, ".download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum := hexSum(h); r.SHA256 != "" && sum != strings.ToLower(r.SHA256) {
+		return util.Permanent(fmt.Errorf("%s has sha256 %s, expected %s", r.URL, sum, r.SHA256))
+	}
+	return os.Rename(tmp.Name(), cached)
+}
+
+// authHeader reads a header from file, given as "Name: value", or as the value of Authorization.
+func authHeader(file string) (http.Header, error) {
+	header := http.Header{}
+	if file == "" {
+		return header, nil
+	}
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	line := strings.TrimSpace(string(bytes))
+	if i := strings.Index(line, ":"); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+		header.Set(line[:i], strings.TrimSpace(line[i+1:]))
+	} else {
+		header.Set("Authorization", line)
+	}
+	return header, nil
+}
+
+// install copies the cached file to path, unless it is already there.
+func install(cached, path string, perm os.FileMode) error {
+	want, err := fileSHA256(cached)
+	if err != nil {
+		return err
+	}
+	if have, err := fileSHA256(path); err == nil && have == want {
+		return os.Chmod(path, perm)
+	}
+
+	if err := util.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	src, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	logrus.Infof("wrote %s", path)
+	return os.Rename(tmp.Name(), path)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hexSum(h), nil
+}
+
+func hexSum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
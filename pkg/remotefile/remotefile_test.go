@@ -0,0 +1,160 @@
+package remotefile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/util"
+)
+
+// setCache points the cache at a temp dir for the test, and returns another temp dir for the files.
+func setCache(t *testing.T) string {
+	cache := Cache
+	Cache = t.TempDir()
+	t.Cleanup(func() { Cache = cache })
+	return t.TempDir()
+}
+
+func sum(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+func TestCacheFallback(t *testing.T) {
+	dir := setCache(t)
+	status, requests := http.StatusOK, 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("images v1"))
+	}))
+	defer s.Close()
+
+	r := config.RemoteFile{URL: s.URL + "/images.tar", Path: filepath.Join(dir, "images.tar")}
+	cfg := &config.CloudConfig{K3OS: config.K3OS{RemoteFiles: []config.RemoteFile{r}}}
+	if err := FetchRemoteFiles(cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(r.Path)
+
+	defer util.ConfigureHTTP(util.HTTPOptions{})
+	if err := util.ConfigureHTTP(util.HTTPOptions{Retries: 2, RetryDelay: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusServiceUnavailable
+	requests = 0
+	start := time.Now()
+	if err := FetchRemoteFiles(cfg, true); err != nil {
+		t.Fatalf("expected the cached copy to be used: %v", err)
+	}
+	if requests != 3 || time.Since(start) > 5*time.Second {
+		t.Errorf("got %d requests in %v, expected 3 before falling back to the cache", requests, time.Since(start))
+	}
+	if got, err := ioutil.ReadFile(r.Path); err != nil || string(got) != "images v1" {
+		t.Errorf("got %q, %v, expected the cached copy", got, err)
+	}
+
+	// without the network the cached copy is put in place without any request
+	os.Remove(r.Path)
+	requests = 0
+	if err := FetchRemoteFiles(cfg, false); err != nil || requests != 0 {
+		t.Fatalf("got %v after %d requests, expected the cached copy", err, requests)
+	}
+	if got, err := ioutil.ReadFile(r.Path); err != nil || string(got) != "images v1" {
+		t.Errorf("got %q, %v, expected the cached copy", got, err)
+	}
+
+	// a url that was never downloaded fails while the server does
+	cfg.K3OS.RemoteFiles[0].URL = s.URL + "/other.tar"
+	if err := FetchRemoteFiles(cfg, true); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, expected a 503 error", err)
+	}
+}
+
+func TestSHA256Mismatch(t *testing.T) {
+	dir := setCache(t)
+	content, requests := "images v1", 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(content))
+	}))
+	defer s.Close()
+
+	r := config.RemoteFile{URL: s.URL + "/images.tar", Path: filepath.Join(dir, "images.tar"), SHA256: strings.ToUpper(sum("images v1"))}
+	cfg := &config.CloudConfig{K3OS: config.K3OS{RemoteFiles: []config.RemoteFile{r}}}
+	if err := FetchRemoteFiles(cfg, true); err != nil {
+		t.Fatalf("an upper case sha256 should match: %v", err)
+	}
+	requests = 0
+	if err := FetchRemoteFiles(cfg, true); err != nil || requests != 0 {
+		t.Errorf("got %v after %d requests, expected the file that has the sha256 not to be downloaded", err, requests)
+	}
+
+	defer util.ConfigureHTTP(util.HTTPOptions{})
+	if err := util.ConfigureHTTP(util.HTTPOptions{Retries: 2, RetryDelay: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	content = "images v2"
+	cfg.K3OS.RemoteFiles[0].SHA256 = sum("images v3")
+	if err := FetchRemoteFiles(cfg, true); err == nil || !strings.Contains(err.Error(), "does not have sha256") {
+		t.Errorf("got %v, expected the cached copy of the previous sha256 to be rejected", err)
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, a sha256 mismatch should not be retried", requests)
+	}
+	if got, err := ioutil.ReadFile(CachePath(r.URL)); err != nil || string(got) != "images v1" {
+		t.Errorf("got cached %q, %v, a download with the wrong sha256 should not be cached", got, err)
+	}
+	if got, err := ioutil.ReadFile(r.Path); err != nil || string(got) != "images v1" {
+		t.Errorf("got %q, %v, a download with the wrong sha256 should not be installed", got, err)
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	dir := setCache(t)
+	var headers []http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		w.Write([]byte("helper"))
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		content, name, value string
+	}{
+		{"Authorization: Bearer abc\n", "Authorization", "Bearer abc"},
+		{"X-Api-Key:  secret \n", "X-Api-Key", "secret"},
+		{"Bearer abc\n", "Authorization", "Bearer abc"},
+		{"token with: colon", "Authorization", "token with: colon"},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("token%d", i))
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		headers = nil
+		r := config.RemoteFile{URL: fmt.Sprintf("%s/helper%d", s.URL, i), Path: filepath.Join(dir, "helper"), AuthHeaderFile: file}
+		if err := FetchRemoteFiles(&config.CloudConfig{K3OS: config.K3OS{RemoteFiles: []config.RemoteFile{r}}}, true); err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) != 1 || headers[0].Get(tt.name) != tt.value {
+			t.Errorf("%q: got %d requests, expected one with %s: %s", tt.content, len(headers), tt.name, tt.value)
+		}
+	}
+
+	r := config.RemoteFile{URL: s.URL + "/missing", Path: filepath.Join(dir, "missing"), AuthHeaderFile: filepath.Join(dir, "missing-token")}
+	if err := FetchRemoteFiles(&config.CloudConfig{K3OS: config.K3OS{RemoteFiles: []config.RemoteFile{r}}}, true); err == nil {
+		t.Errorf("expected a missing auth_header_file to fail")
+	}
+}
@@ -0,0 +1,230 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rancher/k3os/pkg/system"
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultKeyTimeout bounds fetching a key source when k3os.ssh_key_timeout is not set
+	DefaultKeyTimeout = 30 * time.Second
+	requestTimeout    = 10 * time.Second
+)
+
+// KeyCache holds the last keys fetched from each source, so that they can be applied while offline.
+var KeyCache = system.LocalPath("ssh-keys")
+
+// Provider fetches the authorized keys of a source such as github:user.
+type Provider interface {
+	// Fetch returns the keys of source, or an error, which is retried unless it is util.Permanent.
+	Fetch(ctx context.Context, source *url.URL) ([]byte, error)
+	// Offline reports whether the keys can be fetched without the network.
+	Offline() bool
+}
+
+var (
+	providersLock sync.Mutex
+	providers     = map[string]Provider{}
+)
+
+// RegisterProvider makes the keys of sources with scheme fetched by p.
+func RegisterProvider(scheme string, p Provider) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	providers[scheme] = p
+}
+
+func provider(scheme string) (Provider, bool) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	p, ok := providers[scheme]
+	return p, ok
+}
+
+func init() {
+	RegisterProvider("github", userProvider("https://github.com/%s.keys"))
+	RegisterProvider("gitlab", userProvider("https://gitlab.com/%s.keys"))
+	RegisterProvider("launchpad", userProvider("https://launchpad.net/~%s/+sshkeys"))
+	RegisterProvider("http", urlProvider{})
+	RegisterProvider("https", urlProvider{})
+	RegisterProvider("https+sha256", sha256Provider{})
+	RegisterProvider("file", fileProvider{})
+}
+
+// keyFetcher resolves key sources, retrying for up to timeout, as the network can be up before DNS is ready.
+type keyFetcher struct {
+	withNet bool
+	timeout time.Duration
+}
+
+// fetch returns the keys of source, which is returned as it is if it is a key rather than a source.
+// Without the network, or if fetching fails, the keys last fetched from the source are returned.
+func (f keyFetcher) fetch(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" {
+		return source, nil
+	}
+	p, ok := provider(u.Scheme)
+	if !ok {
+		return "", fmt.Errorf("unknown key provider %q", u.Scheme)
+	}
+
+	if !f.withNet && !p.Offline() {
+		keys, err := readCachedKeys(source)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return keys, err
+	}
+
+	keys, err := f.retry(p, u)
+	if err != nil {
+		cached, cacheErr := readCachedKeys(source)
+		if cacheErr != nil {
+			return "", err
+		}
+		logrus.Warnf("failed to fetch SSH keys from %s, using the keys fetched before: %v", source, err)
+		return cached, nil
+	}
+	if !p.Offline() {
+		if err := writeCachedKeys(source, keys); err != nil {
+			logrus.Warnf("failed to cache SSH keys from %s: %v", source, err)
+		}
+	}
+	return string(keys), nil
+}
+
+func (f keyFetcher) retry(p Provider, source *url.URL) ([]byte, error) {
+	timeout := f.timeout
+	if timeout <= 0 {
+		timeout = DefaultKeyTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var keys []byte
+	err := util.RetryUntilDone(ctx, fmt.Sprintf("fetch SSH keys from %s", source), func() error {
+		var err error
+		keys, err = p.Fetch(ctx, source)
+		return err
+	})
+	return keys, err
+}
+
+func cachedKeysPath(source string) string {
+	return filepath.Join(KeyCache, fmt.Sprintf("%x", sha256.Sum256([]byte(source))))
+}
+
+func readCachedKeys(source string) (string, error) {
+	bytes, err := ioutil.ReadFile(cachedKeysPath(source))
+	return string(bytes), err
+}
+
+func writeCachedKeys(source string, keys []byte) error {
+	if err := os.MkdirAll(KeyCache, 0700); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(cachedKeysPath(source), keys, 0600)
+}
+
+// userProvider fetches the keys of a user, e.g. github:user, from a URL formatted with the name.
+type userProvider string
+
+func (p userProvider) Fetch(ctx context.Context, source *url.URL) ([]byte, error) {
+	if source.Opaque == "" {
+		return nil, util.Permanent(fmt.Errorf("missing user name in %s", source))
+	}
+	return get(ctx, fmt.Sprintf(string(p), source.Opaque))
+}
+
+func (userProvider) Offline() bool {
+	return false
+}
+
+type urlProvider struct{}
+
+func (urlProvider) Fetch(ctx context.Context, source *url.URL) ([]byte, error) {
+	return get(ctx, source.String())
+}
+
+func (urlProvider) Offline() bool {
+	return false
+}
+
+// sha256Provider fetches https+sha256://host/path#<sha256> over https, and fails unless the content has
+// the given hash.
+type sha256Provider struct{}
+
+func (sha256Provider) Fetch(ctx context.Context, source *url.URL) ([]byte, error) {
+	want, err := hex.DecodeString(source.Fragment)
+	if err != nil || len(want) != sha256.Size {
+		return nil, util.Permanent(fmt.Errorf("expected the sha256 of the keys as the fragment of %s", source))
+	}
+	u := *source
+	u.Scheme = "https"
+	u.Fragment = ""
+	keys, err := get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if got := sha256.Sum256(keys); hex.EncodeToString(got[:]) != source.Fragment {
+		return nil, util.Permanent(fmt.Errorf("%s has sha256 %x, expected %s", u.String(), got, source.Fragment))
+	}
+	return keys, nil
+}
+
+func (sha256Provider) Offline() bool {
+	return false
+}
+
+// fileProvider reads file:///path, or file:/path.
+type fileProvider struct{}
+
+func (fileProvider) Fetch(ctx context.Context, source *url.URL) ([]byte, error) {
+	path := source.Path
+	if path == "" {
+		path = source.Opaque
+	}
+	keys, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, util.Permanent(err)
+	}
+	return keys, nil
+}
+
+func (fileProvider) Offline() bool {
+	return true
+}
+
+func get(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, util.Permanent(err)
+	}
+	resp, err := util.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := util.StatusError(url, resp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
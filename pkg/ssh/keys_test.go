@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/k3os/pkg/util"
+)
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE0123456789 alice@example\n"
+
+// serveKeys serves testKey over TLS, or the status returned for the number of the request if it is
+// not 200, with an empty key cache for the test. It returns the number of requests served so far.
+func serveKeys(t *testing.T, status func(request int) int) (*httptest.Server, *int) {
+	requests := 0
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if code := status(requests); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Write([]byte(testKey))
+	}))
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := util.ConfigureHTTP(util.HTTPOptions{CACerts: cert}); err != nil {
+		t.Fatal(err)
+	}
+	cache := KeyCache
+	KeyCache = t.TempDir()
+	t.Cleanup(func() {
+		s.Close()
+		util.ConfigureHTTP(util.HTTPOptions{})
+		KeyCache = cache
+	})
+	return s, &requests
+}
+
+func TestFetchSHA256Mismatch(t *testing.T) {
+	status := http.StatusOK
+	s, requests := serveKeys(t, func(int) int { return status })
+
+	host := strings.TrimPrefix(s.URL, "https://")
+	good := fmt.Sprintf("https+sha256://%s/keys#%x", host, sha256.Sum256([]byte(testKey)))
+	bad := fmt.Sprintf("https+sha256://%s/keys#%x", host, sha256.Sum256([]byte("other")))
+
+	f := keyFetcher{withNet: true, timeout: time.Minute}
+	if keys, err := f.fetch(good); err != nil || keys != testKey {
+		t.Fatalf("got %q, %v, expected the key", keys, err)
+	}
+	*requests = 0
+	if keys, err := f.fetch(bad); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("got %q, %v, expected a sha256 mismatch", keys, err)
+	}
+	if *requests != 1 {
+		t.Errorf("got %d requests, a sha256 mismatch should not be retried", *requests)
+	}
+}
+
+func TestFetchPermanentError(t *testing.T) {
+	s, requests := serveKeys(t, func(int) int { return http.StatusNotFound })
+
+	f := keyFetcher{withNet: true, timeout: time.Minute}
+	if keys, err := f.fetch(s.URL + "/keys"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %q, %v, expected a 404 error", keys, err)
+	}
+	if *requests != 1 {
+		t.Errorf("got %d requests, a 404 should not be retried", *requests)
+	}
+}
+
+func TestFetchFromCache(t *testing.T) {
+	status := http.StatusOK
+	s, requests := serveKeys(t, func(int) int { return status })
+	source := s.URL + "/keys"
+
+	f := keyFetcher{withNet: true, timeout: 100 * time.Millisecond}
+	if keys, err := f.fetch(source); err != nil || keys != testKey {
+		t.Fatalf("got %q, %v, expected the key", keys, err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if keys, err := f.fetch(source); err != nil || keys != testKey {
+		t.Errorf("got %q, %v, expected the cached key while the server fails", keys, err)
+	}
+	before := *requests
+	if keys, err := (keyFetcher{}).fetch(source); err != nil || keys != testKey {
+		t.Errorf("got %q, %v, expected the cached key without the network", keys, err)
+	}
+	if *requests != before {
+		t.Errorf("the server was requested without the network")
+	}
+
+	if keys, err := (keyFetcher{}).fetch(s.URL + "/other"); err != nil || keys != "" {
+		t.Errorf("got %q, %v, expected no keys for a source that was never fetched", keys, err)
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	s, requests := serveKeys(t, func(request int) int {
+		if request == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	source := s.URL + "/keys"
+
+	// k3os.http sets no retries by default, key sources are retried until the timeout anyway
+	f := keyFetcher{withNet: true, timeout: time.Minute}
+	if keys, err := f.fetch(source); err != nil || keys != testKey {
+		t.Errorf("got %q, %v, expected the key once the server recovers", keys, err)
+	}
+	if *requests != 2 {
+		t.Errorf("got %d requests, expected the 503 to be retried once", *requests)
+	}
+}
@@ -0,0 +1,98 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	beginManaged = "# BEGIN k3os managed keys, changes inside this block are overwritten"
+	endManaged   = "# END k3os managed keys"
+	sourcePrefix = "# source: "
+	// configSource is the source of the keys given literally in the config
+	configSource = "config"
+)
+
+// setManagedKeys rewrites the block of file that k3OS manages with keys, leaving the rest of the file
+// as it is. Keys that cannot be fetched keep the lines last written for them.
+func setManagedKeys(keys []string, file string, uid, gid int, fetcher keyFetcher) error {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	outside, previous := parseManaged(string(bytes))
+
+	block := []string{beginManaged}
+	last := ""
+	for _, source := range keys {
+		key, err := fetcher.fetch(source)
+		if err != nil {
+			logrus.Errorf("failed to fetch SSH key %s, keeping the keys last written for it: %v", source, err)
+		}
+		lines := splitKeys(key)
+		if err != nil || key == "" {
+			lines = previous[source]
+		}
+		label := source
+		if key == source {
+			label = configSource
+		}
+		if label != last {
+			block = append(block, sourcePrefix+label)
+			last = label
+		}
+		block = append(block, lines...)
+	}
+	block = append(block, endManaged)
+
+	content := strings.Join(append(outside, block...), "\n") + "\n"
+	if content == string(bytes) {
+		return nil
+	}
+	if err := util.WriteFileAtomic(file, []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Chown(file, uid, gid)
+}
+
+// parseManaged splits the lines of an authorized_keys file into those outside of the managed block and
+// the keys inside it by source.
+func parseManaged(content string) ([]string, map[string][]string) {
+	var (
+		outside []string
+		source  string
+		inside  bool
+	)
+	previous := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		switch {
+		case line == beginManaged:
+			inside = true
+		case line == endManaged:
+			inside = false
+		case !inside:
+			if line != "" || len(outside) > 0 {
+				outside = append(outside, line)
+			}
+		case strings.HasPrefix(line, sourcePrefix):
+			source = strings.TrimPrefix(line, sourcePrefix)
+		default:
+			previous[source] = append(previous[source], line)
+		}
+	}
+	return outside, previous
+}
+
+func splitKeys(keys string) []string {
+	var result []string
+	for _, line := range strings.Split(keys, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseManaged(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		outside  []string
+		previous map[string][]string
+	}{
+		{
+			name:     "missing block",
+			content:  "ssh-rsa AAAA user@host\n",
+			outside:  []string{"ssh-rsa AAAA user@host"},
+			previous: map[string][]string{},
+		},
+		{
+			name: "content outside the block",
+			content: lines("ssh-rsa AAAA before", beginManaged, sourcePrefix+"github:alice", "ssh-ed25519 KEY1",
+				endManaged, "ssh-rsa BBBB after"),
+			outside:  []string{"ssh-rsa AAAA before", "ssh-rsa BBBB after"},
+			previous: map[string][]string{"github:alice": {"ssh-ed25519 KEY1"}},
+		},
+		{
+			name: "duplicate markers",
+			content: lines(beginManaged, sourcePrefix+"github:alice", "ssh-ed25519 KEY1", endManaged,
+				"ssh-rsa AAAA between", beginManaged, sourcePrefix+"github:alice", "ssh-ed25519 KEY2", endManaged),
+			outside:  []string{"ssh-rsa AAAA between"},
+			previous: map[string][]string{"github:alice": {"ssh-ed25519 KEY1", "ssh-ed25519 KEY2"}},
+		},
+		{
+			name:     "missing END marker",
+			content:  lines("ssh-rsa AAAA before", beginManaged, sourcePrefix+"github:alice", "ssh-ed25519 KEY1"),
+			outside:  []string{"ssh-rsa AAAA before"},
+			previous: map[string][]string{"github:alice": {"ssh-ed25519 KEY1"}},
+		},
+	}
+	for _, tt := range tests {
+		outside, previous := parseManaged(tt.content)
+		if !reflect.DeepEqual(outside, tt.outside) {
+			t.Errorf("%s: got outside %q, expected %q", tt.name, outside, tt.outside)
+		}
+		if !reflect.DeepEqual(previous, tt.previous) {
+			t.Errorf("%s: got previous %q, expected %q", tt.name, previous, tt.previous)
+		}
+	}
+}
+
+func TestSetManagedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "managed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(cache string) { KeyCache = cache }(KeyCache)
+	KeyCache = filepath.Join(dir, "cache")
+
+	// offline, github:alice is neither fetched nor cached and keeps the keys of the block
+	source := "github:alice"
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "missing file",
+			expected: lines(beginManaged, sourcePrefix+"config", "ssh-ed25519 LITERAL", sourcePrefix+source, endManaged),
+		},
+		{
+			name:    "missing block",
+			content: lines("ssh-rsa AAAA user@host"),
+			expected: lines("ssh-rsa AAAA user@host", beginManaged, sourcePrefix+"config", "ssh-ed25519 LITERAL",
+				sourcePrefix+source, endManaged),
+		},
+		{
+			name: "content outside the block",
+			content: lines("ssh-rsa AAAA before", beginManaged, sourcePrefix+source, "ssh-ed25519 KEY1", endManaged,
+				"ssh-rsa BBBB after"),
+			expected: lines("ssh-rsa AAAA before", "ssh-rsa BBBB after", beginManaged, sourcePrefix+"config",
+				"ssh-ed25519 LITERAL", sourcePrefix+source, "ssh-ed25519 KEY1", endManaged),
+		},
+		{
+			name: "duplicate markers",
+			content: lines(beginManaged, sourcePrefix+source, "ssh-ed25519 KEY1", endManaged, beginManaged,
+				sourcePrefix+"config", "ssh-ed25519 OLD", endManaged),
+			expected: lines(beginManaged, sourcePrefix+"config", "ssh-ed25519 LITERAL", sourcePrefix+source,
+				"ssh-ed25519 KEY1", endManaged),
+		},
+		{
+			name:    "missing END marker",
+			content: lines("ssh-rsa AAAA before", beginManaged, sourcePrefix+source, "ssh-ed25519 KEY1"),
+			expected: lines("ssh-rsa AAAA before", beginManaged, sourcePrefix+"config", "ssh-ed25519 LITERAL",
+				sourcePrefix+source, "ssh-ed25519 KEY1", endManaged),
+		},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, "authorized_keys"+string(rune('0'+i)))
+		if tt.content != "" {
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		keys := []string{"ssh-ed25519 LITERAL", source}
+		for run := 0; run < 2; run++ {
+			if err := setManagedKeys(keys, file, os.Getuid(), os.Getgid(), keyFetcher{}); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if bytes, _ := ioutil.ReadFile(file); string(bytes) != tt.expected {
+				t.Errorf("%s: got\n%s\nexpected\n%s", tt.name, bytes, tt.expected)
+			}
+		}
+	}
+}
+
+func lines(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
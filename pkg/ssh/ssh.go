@@ -3,17 +3,16 @@ package ssh
 import (
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/users"
 	"github.com/rancher/k3os/pkg/util"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
 const (
@@ -21,12 +20,39 @@ const (
 	authorizedFile = "authorized_keys"
 )
 
+// SetAuthorizedKeys authorizes ssh_authorized_keys for rancher and the ssh_authorized_keys of each user
+// for that user. In managed mode the keys replace those previously written by k3OS.
 func SetAuthorizedKeys(cfg *config.CloudConfig, withNet bool) error {
-	bytes, err := ioutil.ReadFile("/etc/passwd")
-	if err != nil {
-		return err
+	managed := cfg.SSHAuthorizedKeysMode == config.SSHKeysManaged
+	fetcher := keyFetcher{withNet: withNet}
+	if cfg.K3OS.SSHKeyTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.K3OS.SSHKeyTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid k3os.ssh_key_timeout: %v", err)
+		}
+		fetcher.timeout = timeout
+	}
+
+	var errs []error
+	if err := authorizeSSHKeys("rancher", cfg.SSHAuthorizedKeys, fetcher, managed); err != nil {
+		errs = append(errs, err)
+	}
+	for _, u := range cfg.Users {
+		if len(u.SSHAuthorizedKeys) == 0 && !managed {
+			continue
+		}
+		if err := authorizeSSHKeys(u.Name, u.SSHAuthorizedKeys, fetcher, managed); err != nil {
+			errs = append(errs, fmt.Errorf("failed to authorize SSH keys of %s: %v", u.Name, err))
+		}
 	}
-	uid, gid, homeDir, err := findUserHomeDir(bytes, "rancher")
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+func authorizeSSHKeys(username string, keys []string, fetcher keyFetcher, managed bool) error {
+	uid, gid, homeDir, err := users.Lookup(username)
 	if err != nil {
 		return err
 	}
@@ -42,57 +68,19 @@ func SetAuthorizedKeys(cfg *config.CloudConfig, withNet bool) error {
 		return err
 	}
 	userAuthorizedFile := path.Join(userSSHDir, authorizedFile)
-	for _, key := range cfg.SSHAuthorizedKeys {
-		if err = authorizeSSHKey(key, userAuthorizedFile, uid, gid, withNet); err != nil {
+	if managed {
+		return setManagedKeys(keys, userAuthorizedFile, uid, gid, fetcher)
+	}
+	for _, key := range keys {
+		if err = authorizeSSHKey(key, userAuthorizedFile, uid, gid, fetcher); err != nil {
 			logrus.Errorf("failed to authorize SSH key %s: %v", key, err)
 		}
 	}
 	return nil
 }
 
-func getKey(key string, withNet bool) (string, error) {
-	providers := map[string]string{
-		"github": "https://github.com/%s.keys",
-		"gitlab": "https://gitlab.com/%s.keys",
-	}
-
-	url, err := url.Parse(key)
-	if err != nil || url.Scheme == "" {
-		return key, nil
-	}
-
-	if !withNet {
-		return "", nil
-	}
-
-	if providerURL, ok := providers[url.Scheme]; ok {
-		key = fmt.Sprintf(providerURL, url.Opaque)
-	}
-
-	var resp *http.Response
-	for i := 0; i < 10; time.Sleep(time.Second) {
-		// network interface(s) can be up before DNS is ready, so let's try up to 10 times
-		resp, err = http.Get(key)
-		if err == nil || strings.Contains(err.Error(), "unsupported protocol scheme") {
-			break
-		}
-		i++
-	}
-	if err != nil {
-		return "", err
-	}
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
-	if resp.StatusCode/100 > 2 {
-		return "", fmt.Errorf("%s %s", resp.Proto, resp.Status)
-	}
-	bytes, err := ioutil.ReadAll(resp.Body)
-	return string(bytes), err
-}
-
-func authorizeSSHKey(key, file string, uid, gid int, withNet bool) error {
-	key, err := getKey(key, withNet)
+func authorizeSSHKey(key, file string, uid, gid int, fetcher keyFetcher) error {
+	key, err := fetcher.fetch(key)
 	if err != nil || key == "" {
 		return err
 	}
@@ -130,24 +118,3 @@ func authorizeSSHKey(key, file string, uid, gid int, withNet bool) error {
 	}
 	return os.Chown(file, uid, gid)
 }
-
-func findUserHomeDir(bytes []byte, username string) (uid, gid int, homeDir string, err error) {
-	for _, line := range strings.Split(string(bytes), "\n") {
-		if strings.HasPrefix(line, username) {
-			split := strings.Split(line, ":")
-			if len(split) < 6 {
-				break
-			}
-			uid, err = strconv.Atoi(split[2])
-			if err != nil {
-				return -1, -1, "", err
-			}
-			gid, err = strconv.Atoi(split[3])
-			if err != nil {
-				return -1, -1, "", err
-			}
-			homeDir = split[5]
-		}
-	}
-	return
-}
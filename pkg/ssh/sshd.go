@@ -0,0 +1,340 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	sshdConfig        = "/etc/ssh/sshd_config"
+	trustedUserCAKeys = "/etc/ssh/trusted_user_ca_keys"
+	// sshd uses the first value of most keywords, so the settings are written at the top of sshd_config
+	beginSettings = "# BEGIN k3os managed settings, changes inside this block are overwritten"
+	endSettings   = "# END k3os managed settings"
+)
+
+var (
+	principalsDir = "/etc/ssh/auth_principals"
+	hostKeyDir    = "/etc/ssh"
+)
+
+// ConfigureSSHD writes the CA keys, authorized principals, host keys and host certificates of cfg to
+// /etc/ssh, merges k3os.ssh into sshd_config and reloads sshd if anything changed. sshd_config is only
+// replaced once sshd -t accepts it.
+func ConfigureSSHD(cfg *config.CloudConfig) error {
+	var (
+		errs    []error
+		changed bool
+	)
+	record := func(c bool, err error) {
+		changed = changed || c
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	sshCfg := cfg.K3OS.SSH
+	if sshCfg == nil {
+		sshCfg = &config.SSH{}
+	}
+	if err := sshCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid k3os.ssh: %v", err)
+	}
+	settings := sshdSettings(sshCfg)
+
+	if len(sshCfg.TrustedUserCAKeys) > 0 {
+		settings = append(settings, "TrustedUserCAKeys "+trustedUserCAKeys)
+		record(writeIfChanged(trustedUserCAKeys, []byte(strings.Join(sshCfg.TrustedUserCAKeys, "\n")+"\n"), 0644))
+	} else {
+		record(remove(trustedUserCAKeys))
+	}
+
+	principals := authorizedPrincipals(cfg)
+	if len(principals) > 0 {
+		settings = append(settings, "AuthorizedPrincipalsFile "+principalsDir+"/%u")
+		record(writePrincipals(principals))
+	} else {
+		record(remove(principalsDir))
+	}
+
+	for _, k := range sshCfg.HostKeys {
+		c, err := writeHostKey(k)
+		record(c, err)
+		if err == nil && k.Certificate != "" {
+			settings = append(settings, "HostCertificate "+hostKeyPath(k.Type)+"-cert.pub")
+		}
+	}
+
+	record(writeSettings(settings))
+
+	if changed {
+		if err := reloadSSHD(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+// sshdSettings returns the sshd_config settings of k3os.ssh, other than those of the files it writes.
+func sshdSettings(s *config.SSH) []string {
+	var settings []string
+	if s.Port > 0 {
+		settings = append(settings, fmt.Sprintf("Port %d", s.Port))
+	}
+	for _, addr := range s.ListenAddresses {
+		settings = append(settings, "ListenAddress "+addr)
+	}
+	if s.PasswordAuthentication != nil {
+		if *s.PasswordAuthentication {
+			settings = append(settings, "PasswordAuthentication yes")
+		} else {
+			settings = append(settings, "PasswordAuthentication no")
+		}
+	}
+	if s.PermitRootLogin != "" {
+		settings = append(settings, "PermitRootLogin "+s.PermitRootLogin)
+	}
+	for _, list := range []struct {
+		keyword string
+		values  []string
+	}{
+		{"Ciphers", s.Ciphers},
+		{"MACs", s.MACs},
+		{"KexAlgorithms", s.KexAlgorithms},
+	} {
+		if len(list.values) > 0 {
+			settings = append(settings, list.keyword+" "+strings.Join(list.values, ","))
+		}
+	}
+	if len(s.AllowUsers) > 0 {
+		settings = append(settings, "AllowUsers "+strings.Join(s.AllowUsers, " "))
+	}
+	return settings
+}
+
+// authorizedPrincipals returns the principals of rancher and each user, or nothing if none are set.
+// Once sshd has an AuthorizedPrincipalsFile it no longer accepts the user name as a principal, so users
+// without principals are given their own name.
+func authorizedPrincipals(cfg *config.CloudConfig) map[string][]string {
+	result := map[string][]string{
+		"rancher": cfg.SSHAuthorizedPrincipals,
+	}
+	set := len(cfg.SSHAuthorizedPrincipals) > 0
+	for _, u := range cfg.Users {
+		result[u.Name] = u.SSHAuthorizedPrincipals
+		set = set || len(u.SSHAuthorizedPrincipals) > 0
+	}
+	if !set {
+		return nil
+	}
+	for name, principals := range result {
+		if len(principals) == 0 {
+			result[name] = []string{name}
+		}
+	}
+	return result
+}
+
+func writePrincipals(principals map[string][]string) (bool, error) {
+	if err := os.MkdirAll(principalsDir, 0755); err != nil {
+		return false, err
+	}
+	changed := false
+	for name, p := range principals {
+		if err := config.ValidatePrincipals(p); err != nil {
+			return changed, fmt.Errorf("principals of %s: %v", name, err)
+		}
+		c, err := writeIfChanged(filepath.Join(principalsDir, name), []byte(strings.Join(p, "\n")+"\n"), 0644)
+		changed = changed || c
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	// users removed from the config lose their principals
+	files, err := ioutil.ReadDir(principalsDir)
+	if err != nil {
+		return changed, err
+	}
+	for _, f := range files {
+		if _, ok := principals[f.Name()]; !ok {
+			c, err := remove(filepath.Join(principalsDir, f.Name()))
+			changed = changed || c
+			if err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+func hostKeyPath(keyType string) string {
+	return filepath.Join(hostKeyDir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+// writeHostKey replaces the host key of k.Type, along with its public key, and writes its certificate.
+func writeHostKey(k config.SSHHostKey) (bool, error) {
+	path := hostKeyPath(k.Type)
+	changed := false
+	if k.Key != "" {
+		c, err := writeKeyPair(path, []byte(strings.TrimSpace(k.Key)+"\n"))
+		if err != nil {
+			return c, fmt.Errorf("failed to write %s host key: %v", k.Type, err)
+		}
+		changed = c
+	}
+	if k.Certificate != "" {
+		c, err := writeIfChanged(path+"-cert.pub", []byte(strings.TrimSpace(k.Certificate)+"\n"), 0644)
+		changed = changed || c
+		if err != nil {
+			return changed, fmt.Errorf("failed to write %s host certificate: %v", k.Type, err)
+		}
+	}
+	return changed, nil
+}
+
+// writeKeyPair replaces the private key at path and its public key. The key is checked by deriving its
+// public key from a temp file first, so that an invalid key leaves the current pair in place.
+func writeKeyPair(path string, key []byte) (bool, error) {
+	tmp, pubTmp := path+".k3os", path+".pub.k3os"
+	defer os.Remove(tmp)
+	defer os.Remove(pubTmp)
+	if err := writeFile(tmp, key, 0600); err != nil {
+		return false, err
+	}
+	pub, err := exec.Command("ssh-keygen", "-y", "-f", tmp).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return false, fmt.Errorf("invalid key: %v: %s", err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return false, err
+	}
+	if unchanged(path, key, 0600) && unchanged(path+".pub", pub, 0644) {
+		return false, nil
+	}
+
+	if err := writeFile(pubTmp, pub, 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	return true, os.Rename(pubTmp, path+".pub")
+}
+
+// writeFile creates path with content and perm. A file left behind at path is removed first, so that the
+// content is never readable with its mode.
+func writeFile(path string, content []byte, perm os.FileMode) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ioutil.WriteFile(path, content, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// writeSettings replaces the block of sshd_config that k3OS manages with settings, unless sshd rejects
+// the result, in which case sshd_config is left as it is.
+func writeSettings(settings []string) (bool, error) {
+	current, err := ioutil.ReadFile(sshdConfig)
+	if err != nil {
+		return false, err
+	}
+	desired := []byte(withSettings(string(current), settings))
+	if bytes.Equal(current, desired) {
+		return false, nil
+	}
+
+	// written next to sshd_config so that it can be renamed over it
+	tmp := sshdConfig + ".k3os"
+	if err := ioutil.WriteFile(tmp, desired, 0644); err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+	if err := testSSHD(tmp); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, sshdConfig)
+}
+
+// testSSHD checks the config file with sshd -t. sshd generates its missing host keys when it starts,
+// which has not happened yet during the boot phase, and without them sshd -t fails.
+func testSSHD(file string) error {
+	if output, err := exec.Command("ssh-keygen", "-A").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to generate host keys: %v: %s", err, bytes.TrimSpace(output))
+	}
+	if output, err := exec.Command("sshd", "-t", "-f", file).CombinedOutput(); err != nil {
+		return fmt.Errorf("sshd rejected the k3os.ssh settings, keeping %s: %v: %s", sshdConfig, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// withSettings returns content with its managed block replaced by settings, at the top.
+func withSettings(content string, settings []string) string {
+	var (
+		rest   []string
+		inside bool
+	)
+	for _, line := range strings.SplitAfter(content, "\n") {
+		switch {
+		case strings.TrimSpace(line) == beginSettings:
+			inside = true
+		case strings.TrimSpace(line) == endSettings:
+			inside = false
+		case !inside && line != "":
+			rest = append(rest, line)
+		}
+	}
+	if len(settings) == 0 {
+		return strings.Join(rest, "")
+	}
+	block := beginSettings + "\n" + strings.Join(settings, "\n") + "\n" + endSettings + "\n"
+	return block + strings.Join(rest, "")
+}
+
+func writeIfChanged(path string, content []byte, perm os.FileMode) (bool, error) {
+	if unchanged(path, content, perm) {
+		return false, nil
+	}
+	return true, util.WriteFileAtomic(path, content, perm)
+}
+
+// unchanged returns whether the file at path has content and perm.
+func unchanged(path string, content []byte, perm os.FileMode) bool {
+	current, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(current, content) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().Perm() == perm
+}
+
+func remove(path string) (bool, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, os.RemoveAll(path)
+}
+
+func reloadSSHD() error {
+	logrus.Debugf("reloading sshd")
+	output, err := exec.Command("rc-service", "--ifstarted", "sshd", "reload").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to reload sshd: %v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
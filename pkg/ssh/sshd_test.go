@@ -0,0 +1,205 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3os/pkg/config"
+)
+
+func TestSSHDSettingsPasswordAuthentication(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		value    *bool
+		settings []string
+	}{
+		{nil, nil},
+		{&yes, []string{"PasswordAuthentication yes"}},
+		{&no, []string{"PasswordAuthentication no"}},
+	}
+	for _, tt := range tests {
+		if settings := sshdSettings(&config.SSH{PasswordAuthentication: tt.value}); !reflect.DeepEqual(settings, tt.settings) {
+			t.Errorf("got %q, expected %q", settings, tt.settings)
+		}
+	}
+}
+
+func TestWithSettings(t *testing.T) {
+	settings := []string{"Port 2222", "PasswordAuthentication no"}
+	block := lines(beginSettings, "Port 2222", "PasswordAuthentication no", endSettings)
+	tests := []struct {
+		name     string
+		content  string
+		settings []string
+		expected string
+	}{
+		{
+			name:     "no block",
+			content:  lines("Port 22", "UsePAM yes"),
+			settings: settings,
+			expected: block + lines("Port 22", "UsePAM yes"),
+		},
+		{
+			name:     "block at the top",
+			content:  lines(beginSettings, "Port 2200", endSettings, "UsePAM yes"),
+			settings: settings,
+			expected: block + lines("UsePAM yes"),
+		},
+		{
+			name:     "block moved to the top",
+			content:  lines("UsePAM yes", beginSettings, "Port 2200", endSettings, "Subsystem sftp internal-sftp"),
+			settings: settings,
+			expected: block + lines("UsePAM yes", "Subsystem sftp internal-sftp"),
+		},
+		{
+			name:     "block removed",
+			content:  lines(beginSettings, "Port 2200", endSettings, "UsePAM yes"),
+			expected: lines("UsePAM yes"),
+		},
+		{
+			name:     "empty file",
+			settings: settings,
+			expected: block,
+		},
+	}
+	for _, tt := range tests {
+		if got := withSettings(tt.content, tt.settings); got != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestAuthorizedPrincipals(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.CloudConfig
+		expected map[string][]string
+	}{
+		{
+			name: "none set",
+			cfg:  config.CloudConfig{Users: []config.User{{Name: "alice"}}},
+		},
+		{
+			name: "rancher only",
+			cfg: config.CloudConfig{
+				SSHAuthorizedPrincipals: []string{"ops"},
+				Users:                   []config.User{{Name: "alice"}},
+			},
+			expected: map[string][]string{"rancher": {"ops"}, "alice": {"alice"}},
+		},
+		{
+			name: "user only",
+			cfg: config.CloudConfig{
+				Users: []config.User{{Name: "alice", SSHAuthorizedPrincipals: []string{"ops", "dev"}}, {Name: "bob"}},
+			},
+			expected: map[string][]string{"rancher": {"rancher"}, "alice": {"ops", "dev"}, "bob": {"bob"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := authorizedPrincipals(&tt.cfg); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestWritePrincipals(t *testing.T) {
+	defer func(dir string) { principalsDir = dir }(principalsDir)
+	principalsDir = filepath.Join(t.TempDir(), "auth_principals")
+
+	tests := []struct {
+		principals map[string][]string
+		changed    bool
+		expected   map[string]string
+	}{
+		{
+			principals: map[string][]string{"rancher": {"rancher"}, "alice": {"ops", "dev"}},
+			changed:    true,
+			expected:   map[string]string{"rancher": "rancher\n", "alice": "ops\ndev\n"},
+		},
+		{
+			principals: map[string][]string{"rancher": {"rancher"}, "alice": {"ops", "dev"}},
+			expected:   map[string]string{"rancher": "rancher\n", "alice": "ops\ndev\n"},
+		},
+		{
+			principals: map[string][]string{"rancher": {"ops"}},
+			changed:    true,
+			expected:   map[string]string{"rancher": "ops\n"},
+		},
+	}
+	for i, tt := range tests {
+		changed, err := writePrincipals(tt.principals)
+		if err != nil || changed != tt.changed {
+			t.Errorf("%d: got %v, %v, expected changed %v", i, changed, err, tt.changed)
+		}
+		files, err := ioutil.ReadDir(principalsDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, f := range files {
+			content, err := ioutil.ReadFile(filepath.Join(principalsDir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[f.Name()] = string(content)
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%d: got %q, expected %q", i, got, tt.expected)
+		}
+	}
+
+	if _, err := writePrincipals(map[string][]string{"rancher": {"two words"}}); err == nil {
+		t.Errorf("expected an invalid principal to fail")
+	}
+}
+
+func TestWriteHostKey(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	defer func(dir string) { hostKeyDir = dir }(hostKeyDir)
+	hostKeyDir = t.TempDir()
+
+	generated := filepath.Join(t.TempDir(), "key")
+	if output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", generated).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	key, err := ioutil.ReadFile(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ioutil.ReadFile(generated + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, changed := range []bool{true, false} {
+		if c, err := writeHostKey(config.SSHHostKey{Type: "ed25519", Key: string(key)}); err != nil || c != changed {
+			t.Errorf("got %v, %v, expected changed %v", c, err, changed)
+		}
+	}
+
+	path := hostKeyPath("ed25519")
+	if _, err := writeHostKey(config.SSHHostKey{Type: "ed25519", Key: "not a key"}); err == nil {
+		t.Errorf("expected an invalid key to fail")
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != string(key) {
+		t.Errorf("got %q, %v, expected an invalid key to leave the key in place", got, err)
+	}
+	// depending on its version, ssh-keygen -y drops the comment of the key
+	got, err := ioutil.ReadFile(path + ".pub")
+	if fields := strings.Fields(string(got)); err != nil || len(fields) < 2 || !reflect.DeepEqual(fields[:2], strings.Fields(string(pub))[:2]) {
+		t.Errorf("got %q, %v, expected the public key %q", got, err, pub)
+	}
+	if files, _ := filepath.Glob(filepath.Join(hostKeyDir, "*.k3os")); len(files) != 0 {
+		t.Errorf("temp files were left behind: %v", files)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got %v, %v, expected mode 0600", info, err)
+	}
+}
@@ -1,21 +1,93 @@
 package sysctl
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/rancher/k3os/pkg/config"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
+// procSys is where the sysctls are, a variable for the tests.
+var procSys = "/proc/sys"
+
+// ConfigureSysctl sets the sysctls of cfg in the order of their keys, and checks that each one reads
+// back as it was written, unless it is write-only. A sysctl that fails does not keep the others from being set.
 func ConfigureSysctl(cfg *config.CloudConfig) error {
-	for k, v := range cfg.K3OS.Sysctls {
-		elements := []string{"/proc", "sys"}
-		elements = append(elements, strings.Split(k, ".")...)
-		path := path.Join(elements...)
-		if err := ioutil.WriteFile(path, []byte(v), 0644); err != nil {
-			return err
+	var keys []string
+	for k := range cfg.K3OS.Sysctls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, k := range keys {
+		if err := set(k, cfg.K3OS.Sysctls[k]); err != nil {
+			errs = append(errs, fmt.Errorf("sysctl %s: %v", k, err))
+			continue
 		}
+		logrus.Debugf("sysctl %s set to %s", k, cfg.K3OS.Sysctls[k])
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+func set(key, value string) error {
+	if err := ioutil.WriteFile(Path(key), []byte(value), 0644); err != nil {
+		return err
+	}
+	// write-only sysctls such as vm.drop_caches trigger an action rather than hold a value
+	if writeOnly(Path(key)) {
+		return nil
+	}
+	current, err := Current(key)
+	if os.IsPermission(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read back: %v", err)
+	}
+	if !Equal(current, value) {
+		return fmt.Errorf("wrote %q but reads back %q", value, current)
 	}
 	return nil
 }
+
+func writeOnly(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().Perm()&0444 == 0
+}
+
+// Equal reports whether two values of a sysctl are the same, ignoring the whitespace between fields,
+// as the kernel separates the fields of values such as kernel.printk with tabs.
+func Equal(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
+
+// Current returns the current value of a sysctl.
+func Current(key string) (string, error) {
+	bytes, err := ioutil.ReadFile(Path(key))
+	return strings.TrimSpace(string(bytes)), err
+}
+
+// Path returns the file in /proc/sys that holds a sysctl. As with sysctl(8), whichever of . and / comes
+// first in the key separates its elements, and the other one stands for a literal dot, so that
+// net.ipv4.conf.eth0/1.rp_filter and net/ipv4/conf/eth0.1/rp_filter both set rp_filter of eth0.1.
+func Path(key string) string {
+	sep, literal := ".", "/"
+	if i := strings.IndexAny(key, "./"); i >= 0 && key[i] == '/' {
+		sep, literal = "/", "."
+	}
+	elements := []string{procSys}
+	for _, e := range strings.Split(key, sep) {
+		elements = append(elements, strings.Replace(e, literal, ".", -1))
+	}
+	return path.Join(elements...)
+}
@@ -0,0 +1,71 @@
+package sysctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/k3os/pkg/config"
+)
+
+func TestPath(t *testing.T) {
+	tests := map[string]string{
+		"vm.swappiness":                     "/proc/sys/vm/swappiness",
+		"net.ipv4.conf.eth0/1.rp_filter":    "/proc/sys/net/ipv4/conf/eth0.1/rp_filter",
+		"net/ipv4/conf/eth0.1/rp_filter":    "/proc/sys/net/ipv4/conf/eth0.1/rp_filter",
+		"kernel.core_pattern":               "/proc/sys/kernel/core_pattern",
+		"net.ipv4.conf.br-lan/5.forwarding": "/proc/sys/net/ipv4/conf/br-lan.5/forwarding",
+	}
+	for key, expected := range tests {
+		if got := Path(key); got != expected {
+			t.Errorf("%s: got %s, expected %s", key, got, expected)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !Equal("4\t4\t1\t7", "4 4 1 7") {
+		t.Error("expected values differing in whitespace to be equal")
+	}
+	if Equal("1", "0") {
+		t.Error("expected different values not to be equal")
+	}
+}
+
+func TestConfigureSysctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) { procSys = dir }(procSys)
+	procSys = dir
+
+	files := map[string]os.FileMode{
+		"vm/swappiness":        0644,
+		"vm/drop_caches":       0200,
+		"net/ipv4/route/flush": 0200,
+	}
+	for file, mode := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.CloudConfig{K3OS: config.K3OS{Sysctls: map[string]string{
+		"vm.swappiness":        "10",
+		"vm.drop_caches":       "3",
+		"net.ipv4.route.flush": "1",
+	}}}
+	if err := ConfigureSysctl(cfg); err != nil {
+		t.Errorf("write-only sysctls should not be read back: %v", err)
+	}
+	if current, err := Current("vm.swappiness"); err != nil || current != "10" {
+		t.Errorf("vm.swappiness: got %q, %v, expected 10", current, err)
+	}
+}
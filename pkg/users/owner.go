@@ -0,0 +1,85 @@
+package users
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UnknownError is returned for a user or group that does not exist, which it may once users are created.
+type UnknownError struct {
+	Kind string
+	Name string
+}
+
+func (e *UnknownError) Error() string {
+	return fmt.Sprintf("%s %s does not exist", e.Kind, e.Name)
+}
+
+// ResolveOwner returns the uid and gid of owner, given as user, user:group, user: or :group, by name or
+// by id, with the meaning chown gives them: user: has the user's login group, and an id of -1 is left
+// unchanged by os.Chown.
+func ResolveOwner(owner string) (uid, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, gid = -1, -1
+	if parts[0] != "" {
+		entry, err := resolve(passwdFile, "user", parts[0])
+		if err != nil {
+			return -1, -1, err
+		}
+		if uid, err = strconv.Atoi(entry[2]); err != nil {
+			return -1, -1, fmt.Errorf("invalid uid of %s: %v", parts[0], err)
+		}
+		if len(parts) == 2 && parts[1] == "" {
+			if entry[3] == "" {
+				return -1, -1, fmt.Errorf("user %s has no login group", parts[0])
+			}
+			if gid, err = strconv.Atoi(entry[3]); err != nil {
+				return -1, -1, fmt.Errorf("invalid gid of %s: %v", parts[0], err)
+			}
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		entry, err := resolve(groupFile, "group", parts[1])
+		if err != nil {
+			return -1, -1, err
+		}
+		if gid, err = strconv.Atoi(entry[2]); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid of %s: %v", parts[1], err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// resolve returns the entry for a name or an id in a passwd or group file. An id that has no entry
+// resolves to itself, as it does for chown.
+func resolve(file, kind, name string) ([]string, error) {
+	entry, ok, err := findEntry(file, name)
+	if err != nil || ok {
+		return entry, err
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil || id < 0 {
+		return nil, &UnknownError{Kind: kind, Name: name}
+	}
+	entry, ok, err = findID(file, id)
+	if err != nil || ok {
+		return entry, err
+	}
+	return []string{name, "", name, ""}, nil
+}
+
+// findID returns the fields of the line for id in a passwd or group file.
+func findID(file string, id int) ([]string, bool, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) > 3 && fields[2] == strconv.Itoa(id) {
+			return fields, true, nil
+		}
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,65 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(passwd, group string) { passwdFile, groupFile = passwd, group }(passwdFile, groupFile)
+	passwdFile, groupFile = filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+
+	passwd := "root:x:0:0:root:/root:/bin/bash\n" +
+		"rancher:x:1000:1000::/home/rancher:/bin/bash\n" +
+		"nogroup:x:1001::::/bin/sh\n" +
+		"broken:x:abc:1002::/home/broken:/bin/sh\n"
+	group := "root:x:0:\nrancher:x:1000:\ndocker:x:999:rancher\n"
+	if err := ioutil.WriteFile(passwdFile, []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(groupFile, []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		owner    string
+		uid, gid int
+		err      string
+	}{
+		{"rancher", 1000, -1, ""},
+		{"rancher:", 1000, 1000, ""},
+		{"rancher:docker", 1000, 999, ""},
+		{":docker", -1, 999, ""},
+		{"root:root", 0, 0, ""},
+		{"1000", 1000, -1, ""},
+		{"1000:", 1000, 1000, ""},
+		{"1000:999", 1000, 999, ""},
+		{"2000:3000", 2000, 3000, ""},
+		{"2000:", -1, -1, "user 2000 has no login group"},
+		{"nogroup:", -1, -1, "user nogroup has no login group"},
+		{"jdoe", -1, -1, "user jdoe does not exist"},
+		{"rancher:wheel", -1, -1, "group wheel does not exist"},
+		{"broken", -1, -1, "invalid uid of broken"},
+		{"-1", -1, -1, "user -1 does not exist"},
+	}
+	for _, tt := range tests {
+		uid, gid, err := ResolveOwner(tt.owner)
+		if uid != tt.uid || gid != tt.gid || tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%q: got %d, %d, %v, expected %d, %d, %q", tt.owner, uid, gid, err, tt.uid, tt.gid, tt.err)
+		}
+	}
+
+	if _, _, err := ResolveOwner("jdoe"); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(*UnknownError); !ok {
+		t.Errorf("got %T, expected an UnknownError so that the file can be written once the user exists", err)
+	}
+}
@@ -0,0 +1,259 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rancher/k3os/pkg/command"
+	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/util"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+	shadowFile = "/etc/shadow"
+)
+
+const (
+	sudoersFile = "/etc/sudoers.d/users"
+	sudoGroup   = "sudo"
+	// noPassword disables password logins while still allowing ssh keys, unlike a locked (!) password
+	noPassword   = "*"
+	defaultShell = "/bin/bash"
+)
+
+// Lookup returns the uid, gid and home directory of username.
+func Lookup(username string) (uid, gid int, homeDir string, err error) {
+	entry, ok, err := findEntry(passwdFile, username)
+	if err != nil {
+		return -1, -1, "", err
+	}
+	if !ok || len(entry) < 6 {
+		return -1, -1, "", &UnknownError{Kind: "user", Name: username}
+	}
+	if uid, err = strconv.Atoi(entry[2]); err != nil {
+		return -1, -1, "", err
+	}
+	if gid, err = strconv.Atoi(entry[3]); err != nil {
+		return -1, -1, "", err
+	}
+	return uid, gid, entry[5], nil
+}
+
+// ConfigureUsers creates the users in cfg along with their groups, and updates the shell, groups and
+// password of the users that already exist.
+func ConfigureUsers(cfg *config.CloudConfig) error {
+	var (
+		errs    []error
+		sudoers []string
+	)
+	for _, u := range cfg.Users {
+		if err := configureUser(u); err != nil {
+			errs = append(errs, fmt.Errorf("failed to configure user %s: %v", u.Name, err))
+			continue
+		}
+		// sudo asks for the user's own password, which users without one do not have
+		if u.Sudo && (u.Password == "" || u.LockPassword) {
+			sudoers = append(sudoers, u.Name+" ALL = (ALL) NOPASSWD: ALL\n")
+		}
+	}
+
+	if err := writeSudoers(sudoers); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+func configureUser(u config.User) error {
+	if err := u.Validate(); err != nil {
+		return err
+	}
+
+	if err := ensureGroup(u.Name, u.GID); err != nil {
+		return err
+	}
+
+	shell := u.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	entry, exists, err := findEntry(passwdFile, u.Name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		args := []string{"-D", "-s", shell, "-G", u.Name}
+		if u.UID > 0 {
+			args = append(args, "-u", strconv.Itoa(u.UID))
+		}
+		if u.HomeDir != "" {
+			args = append(args, "-h", u.HomeDir)
+		}
+		if err := run("adduser", append(args, u.Name)...); err != nil {
+			return err
+		}
+	} else {
+		if u.UID > 0 && entry[2] != strconv.Itoa(u.UID) {
+			return fmt.Errorf("exists with uid %s instead of %d", entry[2], u.UID)
+		}
+		if len(entry) > 6 && entry[6] != shell {
+			if err := setField(passwdFile, u.Name, 6, shell); err != nil {
+				return err
+			}
+		}
+	}
+
+	groups := u.Groups
+	if u.Sudo {
+		groups = append([]string{sudoGroup}, groups...)
+	}
+	for _, g := range groups {
+		if err := ensureGroup(g, 0); err != nil {
+			return err
+		}
+		if err := ensureMember(g, u.Name); err != nil {
+			return err
+		}
+	}
+
+	password := u.Password
+	if password == "" || u.LockPassword {
+		password = noPassword
+	}
+	return setPassword(u.Name, password)
+}
+
+// setPassword sets the hashed password of username, unless it is already set. noPassword is written to
+// the shadow entry as is, chpasswd would take it for a clear text password.
+func setPassword(username, password string) error {
+	entry, _, err := findEntry(shadowFile, username)
+	if err != nil {
+		return err
+	}
+	if len(entry) > 1 && entry[1] == password {
+		return nil
+	}
+	if password == noPassword {
+		return setField(shadowFile, username, 1, noPassword)
+	}
+	return command.SetPassword(username, password)
+}
+
+// ensureGroup creates the group if it does not exist, with gid if it is set.
+func ensureGroup(name string, gid int) error {
+	entry, exists, err := findEntry(groupFile, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if gid > 0 && entry[2] != strconv.Itoa(gid) {
+			return fmt.Errorf("group %s exists with gid %s instead of %d", name, entry[2], gid)
+		}
+		return nil
+	}
+	if gid > 0 {
+		return run("addgroup", "-g", strconv.Itoa(gid), name)
+	}
+	return run("addgroup", name)
+}
+
+func ensureMember(group, username string) error {
+	entry, _, err := findEntry(groupFile, group)
+	if err != nil {
+		return err
+	}
+	if len(entry) > 3 {
+		for _, member := range strings.Split(entry[3], ",") {
+			if member == username {
+				return nil
+			}
+		}
+	}
+	return run("addgroup", username, group)
+}
+
+func writeSudoers(lines []string) error {
+	if len(lines) == 0 {
+		if err := os.Remove(sudoersFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Strings(lines)
+	if err := os.MkdirAll("/etc/sudoers.d", 0750); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(sudoersFile, []byte(strings.Join(lines, "")), 0440)
+}
+
+// findEntry returns the fields of the line for name in a passwd, group or shadow file.
+func findEntry(file, name string) ([]string, bool, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) > 3 && fields[0] == name {
+			return fields, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func readLines(file string) ([]string, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bytes), "\n"), nil
+}
+
+// setField replaces a field of the line for name, keeping the mode and ownership of the file.
+func setField(file, name string, index int, value string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(bytes), "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, ":")
+		if len(fields) > index && fields[0] == name {
+			fields[index] = value
+			lines[i] = strings.Join(fields, ":")
+		}
+	}
+	if err := util.WriteFileAtomic(file, []byte(strings.Join(lines, "\n")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(file, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
+
+func run(name string, args ...string) error {
+	logrus.Debugf("running %s %s", name, strings.Join(args, " "))
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(output))
+	}
+	return nil
+}
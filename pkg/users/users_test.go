@@ -0,0 +1,46 @@
+package users
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetPasswordLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { shadowFile = file }(shadowFile)
+	shadowFile = filepath.Join(dir, "shadow")
+
+	shadow := "root:!::0:::::\nalice:$6$salt$hash:18000:0:99999:7:::\nbob:*:18000:0:99999:7:::\n"
+	if err := ioutil.WriteFile(shadowFile, []byte(shadow), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setPassword("alice", noPassword); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, err := findEntry(shadowFile, "alice")
+	if err != nil || !ok {
+		t.Fatalf("alice is missing from the shadow file: %v", err)
+	}
+	if entry[1] != "*" || entry[2] != "18000" {
+		t.Errorf("got shadow entry %v, expected a * password with the other fields unchanged", entry)
+	}
+	if info, err := os.Stat(shadowFile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("got mode %v, %v, expected 0640", info.Mode().Perm(), err)
+	}
+
+	// bob is already locked, chpasswd must not be run
+	if err := setPassword("bob", noPassword); err != nil {
+		t.Fatal(err)
+	}
+	expected := "root:!::0:::::\nalice:*:18000:0:99999:7:::\nbob:*:18000:0:99999:7:::\n"
+	if bytes, _ := ioutil.ReadFile(shadowFile); string(bytes) != expected {
+		t.Errorf("got shadow file\n%s\nexpected\n%s", bytes, expected)
+	}
+}
@@ -4,9 +4,28 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	// decoders undo the encodings that make binary content fit in a config
+	decoders = map[string]func(string) ([]byte, error){
+		"b64":    DecodeBase64Content,
+		"base64": DecodeBase64Content,
+		"hex":    DecodeHexContent,
+	}
+	decompressors = map[string]func([]byte) ([]byte, error){
+		"gz":   DecompressGzip,
+		"gzip": DecompressGzip,
+		"zstd": DecompressZstd,
+		"xz":   DecompressXz,
+	}
 )
 
 func DecodeBase64Content(content string) ([]byte, error) {
@@ -17,6 +36,15 @@ func DecodeBase64Content(content string) ([]byte, error) {
 	return output, nil
 }
 
+// DecodeHexContent decodes hex, ignoring whitespace so that long content can be split over lines.
+func DecodeHexContent(content string) ([]byte, error) {
+	output, err := hex.DecodeString(strings.Join(strings.Fields(content), ""))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode hex: %q", err)
+	}
+	return output, nil
+}
+
 func DecodeGzipContent(content string) ([]byte, error) {
 	byteContent := []byte(content)
 	return DecompressGzip(byteContent)
@@ -39,20 +67,59 @@ func DecompressGzip(content []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func DecompressZstd(content []byte) ([]byte, error) {
+	zr, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	output, err := zr.DecodeAll(content, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode zstd: %q", err)
+	}
+	return output, nil
+}
+
+func DecompressXz(content []byte) ([]byte, error) {
+	xzr, err := xz.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode xz: %q", err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(xzr); err != nil {
+		return nil, fmt.Errorf("unable to read xz: %q", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeContent decodes content given with encoding, which is b64, hex, a compression such as gz, zstd
+// or xz, or a compression followed by b64 or hex, e.g. gz+b64.
 func DecodeContent(content string, encoding string) ([]byte, error) {
-	switch encoding {
-	case "":
+	if encoding == "" {
 		return []byte(content), nil
-	case "b64", "base64":
-		return DecodeBase64Content(content)
-	case "gz", "gzip":
-		return DecodeGzipContent(content)
-	case "gz+base64", "gzip+base64", "gz+b64", "gzip+b64":
-		gz, err := DecodeBase64Content(content)
-		if err != nil {
+	}
+	if decode, ok := decoders[encoding]; ok {
+		return decode(content)
+	}
+
+	compression, transfer := encoding, ""
+	if i := strings.Index(encoding, "+"); i >= 0 {
+		compression, transfer = encoding[:i], encoding[i+1:]
+	}
+	decompress, ok := decompressors[compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	compressed := []byte(content)
+	if transfer != "" {
+		decode, ok := decoders[transfer]
+		if !ok {
+			return nil, fmt.Errorf("unsupported encoding %q", encoding)
+		}
+		var err error
+		if compressed, err = decode(content); err != nil {
 			return nil, err
 		}
-		return DecodeGzipContent(string(gz))
 	}
-	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	return decompress(compressed)
 }
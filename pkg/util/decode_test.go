@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecodeContent(t *testing.T) {
+	content := []byte("#!/bin/sh\necho hello\n")
+
+	gz := &bytes.Buffer{}
+	gzw := gzip.NewWriter(gz)
+	gzw.Write(content)
+	gzw.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll(content, nil)
+
+	x := &bytes.Buffer{}
+	xw, err := xz.NewWriter(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(content)
+	xw.Close()
+
+	tests := []struct {
+		encoding string
+		encoded  string
+	}{
+		{"", string(content)},
+		{"b64", base64.StdEncoding.EncodeToString(content)},
+		{"hex", hex.EncodeToString(content)},
+		{"hex", hex.EncodeToString(content[:8]) + "\n  " + hex.EncodeToString(content[8:])},
+		{"gz", gz.String()},
+		{"gzip+base64", base64.StdEncoding.EncodeToString(gz.Bytes())},
+		{"zstd", string(zst)},
+		{"zstd+b64", base64.StdEncoding.EncodeToString(zst)},
+		{"xz", x.String()},
+		{"xz+hex", hex.EncodeToString(x.Bytes())},
+	}
+	for _, test := range tests {
+		decoded, err := DecodeContent(test.encoded, test.encoding)
+		if err != nil {
+			t.Errorf("%s: %v", test.encoding, err)
+		} else if !bytes.Equal(decoded, content) {
+			t.Errorf("%s: got %q, expected %q", test.encoding, decoded, content)
+		}
+	}
+
+	for _, encoding := range []string{"rot13", "zstd+rot13", "b64+gz", "xz"} {
+		if _, err := DecodeContent("not encoded", encoding); err == nil {
+			t.Errorf("%s: expected an error", encoding)
+		}
+	}
+}
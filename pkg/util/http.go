@@ -0,0 +1,284 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHTTPTimeout    = 30 * time.Second
+	DefaultHTTPRetryDelay = time.Second
+	// maxRetryDelay caps the doubling of the delay between retries, unless RetryDelay is longer
+	maxRetryDelay = 8 * time.Second
+)
+
+// HTTPOptions configure the client that k3OS downloads with.
+type HTTPOptions struct {
+	// HTTPProxy and HTTPSProxy replace the proxies of the environment when either is set
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy are the hosts, domains and CIDRs that are reached without the proxy, as in NO_PROXY
+	NoProxy []string
+	// CACerts are PEM certificates trusted in addition to the system roots
+	CACerts []byte
+	// Timeout bounds connecting and waiting for the response headers, so that large downloads are not cut off
+	Timeout time.Duration
+	// Retries is how many times Retry retries, waiting RetryDelay, doubled each time up to 8s
+	Retries    int
+	RetryDelay time.Duration
+}
+
+var (
+	httpLock    sync.RWMutex
+	httpOptions = HTTPOptions{Timeout: DefaultHTTPTimeout, RetryDelay: DefaultHTTPRetryDelay}
+	httpClient  = mustHTTPClient(httpOptions)
+)
+
+// ConfigureHTTP replaces the client returned by HTTPClient, and used by the downloads of this package.
+func ConfigureHTTP(opts HTTPOptions) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultHTTPTimeout
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultHTTPRetryDelay
+	}
+	client, err := newHTTPClient(opts)
+	if err != nil {
+		return err
+	}
+	httpLock.Lock()
+	defer httpLock.Unlock()
+	httpOptions, httpClient = opts, client
+	return nil
+}
+
+// HTTPClient returns the client that every download of k3OS should use.
+func HTTPClient() *http.Client {
+	httpLock.RLock()
+	defer httpLock.RUnlock()
+	return httpClient
+}
+
+// permanentError is a failure that retrying will not fix.
+type permanentError struct {
+	error
+}
+
+// Permanent marks err as a failure that Retry does not retry.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Retry calls f until it succeeds or fails permanently, retrying as configured: up to Retries times,
+// waiting RetryDelay, doubled each time up to 8s. It stops waiting once ctx is done. Every download of
+// k3OS is retried with it, so that they all follow k3os.http.
+func Retry(ctx context.Context, what string, f func() error) error {
+	httpLock.RLock()
+	retries := httpOptions.Retries
+	httpLock.RUnlock()
+	return retry(ctx, what, retries, f)
+}
+
+// RetryUntilDone calls f until it succeeds, fails permanently or ctx is done, waiting as Retry does,
+// however many Retries are configured. It is for what has a deadline of its own, such as SSH key sources
+// while the network comes up.
+func RetryUntilDone(ctx context.Context, what string, f func() error) error {
+	return retry(ctx, what, -1, f)
+}
+
+// retry is Retry with up to retries retries, or no limit if retries is negative.
+func retry(ctx context.Context, what string, retries int, f func() error) error {
+	httpLock.RLock()
+	delay := httpOptions.RetryDelay
+	httpLock.RUnlock()
+	limit := maxRetryDelay
+	if delay > limit {
+		limit = delay
+	}
+
+	for i := 0; ; i++ {
+		err := f()
+		if _, permanent := err.(permanentError); err == nil || permanent || retries >= 0 && i >= retries {
+			return err
+		}
+		logrus.Debugf("failed to %s, retrying in %v: %v", what, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > limit {
+			delay = limit
+		}
+	}
+}
+
+// StatusError returns an error for a response to url with a status other than 2xx. It is permanent
+// unless the status is 5xx or 429, as the server may be starting up or overloaded.
+func StatusError(url string, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err := fmt.Errorf("%s: %s %s", url, resp.Proto, resp.Status)
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return Permanent(err)
+}
+
+// HTTPGet gets url with Retry. Any status other than 2xx is returned as an error.
+func HTTPGet(url string) (*http.Response, error) {
+	var resp *http.Response
+	err := Retry(context.Background(), "get "+url, func() error {
+		var err error
+		if resp, err = HTTPClient().Get(url); err != nil {
+			return err
+		}
+		if err := StatusError(url, resp); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func mustHTTPClient(opts HTTPOptions) *http.Client {
+	client, err := newHTTPClient(opts)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func newHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	proxy, err := proxyFunc(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = (&net.Dialer{
+		Timeout:   opts.Timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = opts.Timeout
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	if len(opts.CACerts) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			logrus.Warnf("failed to load the system CA certificates, only trusting the configured ones: %v", err)
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(opts.CACerts) {
+			return nil, fmt.Errorf("no PEM certificates in the CA certificates")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// ParseProxy parses a proxy URL, which defaults to the http scheme as it does in HTTP_PROXY.
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err := url.Parse("http://" + proxy); err == nil && u.Host != "" {
+			return u, nil
+		}
+		return nil, fmt.Errorf("invalid proxy %q", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy %q, expected an http, https or socks5 url", proxy)
+}
+
+// proxyFunc returns the proxies of opts, or of the environment if none are set.
+func proxyFunc(opts HTTPOptions) (func(*http.Request) (*url.URL, error), error) {
+	if opts.HTTPProxy == "" && opts.HTTPSProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxies := map[string]*url.URL{}
+	for scheme, proxy := range map[string]string{"http": opts.HTTPProxy, "https": opts.HTTPSProxy} {
+		if proxy == "" {
+			continue
+		}
+		u, err := ParseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxies[scheme] = u
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		proxy := proxies[req.URL.Scheme]
+		if proxy == nil || NoProxy(opts.NoProxy, req.URL.Host) {
+			return nil, nil
+		}
+		return proxy, nil
+	}, nil
+}
+
+// NoProxy reports whether host, with an optional port, is reached without the proxy. Each entry is a
+// host or domain, which matches its subdomains, optionally with a port, an IP, a CIDR or *. Entries
+// can also be given as a comma separated list, as in NO_PROXY. localhost is never proxied.
+func NoProxy(entries []string, host string) bool {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	hostname = strings.ToLower(strings.Trim(hostname, "[]"))
+	ip := net.ParseIP(hostname)
+	if hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+
+	for _, list := range entries {
+		for _, entry := range strings.Split(list, ",") {
+			entry = strings.ToLower(strings.TrimSpace(entry))
+			switch {
+			case entry == "":
+				continue
+			case entry == "*":
+				return true
+			}
+			if _, cidr, err := net.ParseCIDR(entry); err == nil {
+				if ip != nil && cidr.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if entryIP := net.ParseIP(strings.Trim(entry, "[]")); entryIP != nil {
+				if ip != nil && entryIP.Equal(ip) {
+					return true
+				}
+				continue
+			}
+			if h, p, err := net.SplitHostPort(entry); err == nil {
+				if p != port {
+					continue
+				}
+				entry = h
+			}
+			domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -29,7 +29,7 @@ func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
 }
 
 func HTTPDownloadToFile(url, dest string) error {
-	res, err := http.Get(url)
+	res, err := HTTPGet(url)
 	if err != nil {
 		return err
 	}
@@ -43,7 +43,7 @@ func HTTPDownloadToFile(url, dest string) error {
 
 func HTTPLoadBytes(url string) ([]byte, error) {
 	var resp *http.Response
-	resp, err := http.Get(url)
+	resp, err := HTTPGet(url)
 	if err == nil {
 		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
@@ -1,49 +1,126 @@
 package writefile
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 
 	"github.com/rancher/k3os/pkg/config"
+	"github.com/rancher/k3os/pkg/users"
 	"github.com/rancher/k3os/pkg/util"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
 )
 
-func WriteFiles(cfg *config.CloudConfig) {
+// Options select which write_files entries WriteFiles writes, and how.
+type Options struct {
+	// Deferred selects the files with defer set, instead of those without
+	Deferred bool
+	// WithNet fetches the files with a source, which are otherwise left as they are
+	WithNet bool
+	// RetryLater leaves the files whose owner does not exist yet for a later phase, instead of failing them
+	RetryLater bool
+}
+
+// WriteFiles writes the write_files entries of cfg selected by opts. A file that cannot be written does
+// not keep the others from being written, the failures are returned together.
+func WriteFiles(cfg *config.CloudConfig, opts Options) error {
+	var errs []error
 	for i, f := range cfg.WriteFiles {
-		c, err := util.DecodeContent(f.Content, f.Encoding)
+		if f.Defer != opts.Deferred {
+			continue
+		}
+		c, ok, err := Content(&f, opts.WithNet)
 		if err != nil {
-			logrus.Errorf("failed to decode content from write_files item [%d]: %v", i, err)
+			logrus.Errorf("failed to get content of write_files item [%d]: %v", i, err)
+			errs = append(errs, fmt.Errorf("write_files[%d] %s: %v", i, f.Path, err))
+			continue
+		}
+		if !ok {
+			logrus.Debugf("not fetching %s for %s without the network", f.Source.URL, f.Path)
 			continue
 		}
 		f.Content = string(c)
 		f.Encoding = ""
+		f.Source = nil
 		p, err := WriteFile(&f, "/")
+		if _, unknown := err.(*users.UnknownError); unknown && opts.RetryLater {
+			logrus.Infof("not writing %s yet: %v", f.Path, err)
+			continue
+		}
 		if err != nil {
 			logrus.WithFields(logrus.Fields{"err": err, "path": p}).Errorln("failed to write file")
+			errs = append(errs, fmt.Errorf("write_files[%d] %s: %v", i, f.Path, err))
 			continue
 		}
 		logrus.Infof("wrote file %s to filesystem", p)
 	}
+	if len(errs) > 0 {
+		return cli.NewMultiError(errs...)
+	}
+	return nil
+}
+
+// Content returns what f is written with: its decoded content, or the content fetched from its source,
+// which must have the sha256 of f if it has one. The source is not fetched if the file already has the
+// expected sha256, nor without the network, in which case false is returned.
+func Content(f *config.File, withNet bool) ([]byte, bool, error) {
+	if f.Source == nil {
+		c, err := util.DecodeContent(f.Content, f.Encoding)
+		if err == nil {
+			err = f.VerifySHA256(c)
+		}
+		return c, err == nil, err
+	}
+	if f.ExpectedSHA256() != "" {
+		if current, err := ioutil.ReadFile(f.Path); err == nil && f.VerifySHA256(current) == nil {
+			return current, true, nil
+		}
+	}
+	if !withNet {
+		return nil, false, nil
+	}
+	c, err := util.HTTPLoadBytes(f.Source.URL)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch %s: %v", f.Source.URL, err)
+	}
+	if err := f.VerifySHA256(c); err != nil {
+		return nil, false, fmt.Errorf("%s: %v", f.Source.URL, err)
+	}
+	return c, true, nil
 }
 
 func WriteFile(f *config.File, root string) (string, error) {
 	if f.Encoding != "" {
 		return "", fmt.Errorf("unable to write file with encoding %s", f.Encoding)
 	}
+	// resolved before anything is written, so that nothing is left behind for a file that has to wait
+	// for its owner to be created
+	for _, owner := range []string{f.Owner, f.DirectoryOwner} {
+		if owner != "" {
+			if _, _, err := users.ResolveOwner(owner); err != nil {
+				return "", err
+			}
+		}
+	}
 	p := path.Join(root, f.Path)
 	d := path.Dir(p)
 	logrus.Infof("writing file to %q", d)
-	if err := util.EnsureDirectoryExists(d); err != nil {
+	if err := ensureDirectory(d, f); err != nil {
 		return "", err
 	}
+	if f.LinkTarget != "" {
+		return p, symlink(f.LinkTarget, p)
+	}
 	perm, err := f.Permissions()
 	if err != nil {
 		return "", err
 	}
+	if f.Append {
+		return p, appendFile(p, []byte(f.Content), perm, f.Owner)
+	}
 	var tmp *os.File
 	// create a temporary file in the same directory to ensure it's on the same filesystem
 	if tmp, err = ioutil.TempFile(d, "wfs-temp"); err != nil {
@@ -59,15 +136,103 @@ func WriteFile(f *config.File, root string) (string, error) {
 	if err := os.Chmod(tmp.Name(), perm); err != nil {
 		return "", err
 	}
-	if f.Owner != "" {
-		// we shell out since we don't have a way to look up unix groups natively
-		cmd := exec.Command("chown", f.Owner, tmp.Name())
-		if err := cmd.Run(); err != nil {
-			return "", err
-		}
+	if err := chown(tmp.Name(), f.Owner); err != nil {
+		return "", err
 	}
 	if err := os.Rename(tmp.Name(), p); err != nil {
 		return "", err
 	}
 	return p, nil
 }
+
+// ensureDirectory creates dir and any missing parents of it, with the directory permissions and owner
+// of f. Directories that already exist are left as they are.
+func ensureDirectory(dir string, f *config.File) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := ensureDirectory(path.Dir(dir), f); err != nil {
+		return err
+	}
+	perm, err := f.DirectoryPermissions()
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, perm); err != nil {
+		return err
+	}
+	// the mode given to mkdir is subject to the umask
+	if err := os.Chmod(dir, perm); err != nil {
+		return err
+	}
+	return chown(dir, f.DirectoryOwner)
+}
+
+// symlink points p at target, replacing whatever file p was.
+func symlink(target, p string) error {
+	if current, err := os.Readlink(p); err == nil && current == target {
+		return nil
+	}
+	tmp := path.Join(path.Dir(p), fmt.Sprintf(".%s.wfs-link", path.Base(p)))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Appended returns what a file holds once content is appended to current. It is not appended again if
+// current already ends with it, so that applying the config again does not add it again.
+func Appended(current, content []byte) []byte {
+	if bytes.HasSuffix(current, content) {
+		return current
+	}
+	return append(append([]byte{}, current...), content...)
+}
+
+// appendFile adds content to the end of p as Appended does, creating p if it does not exist.
+func appendFile(p string, content []byte, perm os.FileMode, owner string) error {
+	current, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil || len(Appended(current, content)) != len(current) {
+		file, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(content); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(p, perm); err != nil {
+		return err
+	}
+	return chown(p, owner)
+}
+
+func chown(p, owner string) error {
+	if owner == "" {
+		return nil
+	}
+	uid, gid, err := users.ResolveOwner(owner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(p, uid, gid)
+}
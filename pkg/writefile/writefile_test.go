@@ -0,0 +1,177 @@
+package writefile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3os/pkg/config"
+)
+
+func TestAppend(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hosts, []byte("nameserver 1.1.1.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := config.File{Path: hosts, Append: true, Content: "nameserver 1.1.1.1\n"}
+	for i := 0; i < 2; i++ {
+		if _, err := WriteFile(&f, "/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := ioutil.ReadFile(hosts); err != nil || string(got) != "nameserver 1.1.1.10\nnameserver 1.1.1.1\n" {
+		t.Errorf("got %q, %v, expected the line to be appended once", got, err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if _, err := WriteFile(&config.File{Path: empty, Append: true, RawFilePermissions: "0600"}, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(empty); err != nil || info.Size() != 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected an empty file with mode 0600 to be created, got %v, %v", info, err)
+	}
+}
+
+func TestAppended(t *testing.T) {
+	tests := []struct {
+		current, content, expected string
+	}{
+		{"", "a\n", "a\n"},
+		{"a\n", "a\n", "a\n"},
+		{"a\nb\n", "a\n", "a\nb\na\n"},
+		{"x 1.1.1.10\n", "x 1.1.1.1", "x 1.1.1.10\nx 1.1.1.1"},
+		{"a\n", "", "a\n"},
+	}
+	for _, tt := range tests {
+		if got := string(Appended([]byte(tt.current), []byte(tt.content))); got != tt.expected {
+			t.Errorf("%q + %q: got %q, expected %q", tt.current, tt.content, got, tt.expected)
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	dir := t.TempDir()
+	now, later := filepath.Join(dir, "now"), filepath.Join(dir, "later")
+	cfg := &config.CloudConfig{WriteFiles: []config.File{
+		{Path: now, Content: "now"},
+		{Path: later, Content: "later", Defer: true},
+	}}
+
+	if err := WriteFiles(cfg, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(later); !os.IsNotExist(err) {
+		t.Errorf("the deferred file was written before its turn: %v", err)
+	}
+	os.Remove(now)
+	if err := WriteFiles(cfg, Options{Deferred: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(now); !os.IsNotExist(err) {
+		t.Errorf("the file that is not deferred was written with the deferred files: %v", err)
+	}
+	if got, err := ioutil.ReadFile(later); err != nil || string(got) != "later" {
+		t.Errorf("got %q, %v, expected later", got, err)
+	}
+}
+
+func TestLinkTarget(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "etc", "localtime")
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(link, []byte("a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/Europe/Berlin"} {
+		if _, err := WriteFile(&config.File{Path: link, LinkTarget: target}, "/"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.Readlink(link); err != nil || got != target {
+			t.Errorf("got link %q, %v, expected %q", got, err, target)
+		}
+	}
+}
+
+func TestDirectoryOptions(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	f := config.File{
+		Path:                    filepath.Join(existing, "a", "b", "settings.json"),
+		Content:                 "{}",
+		Owner:                   owner,
+		DirectoryOwner:          owner,
+		RawDirectoryPermissions: "0700",
+	}
+	if _, err := WriteFile(&f, "/"); err != nil {
+		t.Fatal(err)
+	}
+	for path, perm := range map[string]os.FileMode{
+		existing:                          0755,
+		filepath.Join(existing, "a"):      0700,
+		filepath.Join(existing, "a", "b"): 0700,
+	} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != perm {
+			t.Errorf("%s: got %v, %v, expected mode %04o", path, info.Mode().Perm(), err, perm)
+		}
+	}
+	if info, err := os.Stat(f.Path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("got %v, %v, expected mode 0644", info.Mode().Perm(), err)
+	}
+
+	f.Path = filepath.Join(dir, "file", "nested")
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteFile(&f, "/"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("got %v, expected a parent that is a file to fail", err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	dir := t.TempDir()
+	content := "airgap images"
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(dir, "airgap.tar")
+	f := config.File{Path: path, Source: &config.FileSource{URL: srv.URL, SHA256: strings.ToUpper(sum)}}
+	if _, ok, err := Content(&f, false); ok || err != nil {
+		t.Errorf("got %v, %v, expected the source not to be fetched without the network", ok, err)
+	}
+	if c, ok, err := Content(&f, true); !ok || err != nil || string(c) != content {
+		t.Fatalf("got %q, %v, %v, expected the content of the source", c, ok, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	requests = 0
+	if c, ok, err := Content(&f, true); !ok || err != nil || string(c) != content || requests != 0 {
+		t.Errorf("got %q, %v, %v after %d requests, expected the file that has the sha256", c, ok, err, requests)
+	}
+
+	f.Source.SHA256 = fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+	if _, _, err := Content(&f, true); err == nil || !strings.Contains(err.Error(), "expected "+f.Source.SHA256) {
+		t.Errorf("got %v, expected a sha256 mismatch", err)
+	}
+}